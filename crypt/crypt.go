@@ -0,0 +1,260 @@
+// Package crypt implements the envelope encryption used for media
+// stored in the bucket.
+//
+// Each object is encrypted with its own random AES-256 data key, which
+// is itself sealed with a master key and stored (along with the nonce)
+// in the object's metadata.  Content is split into 64KiB segments, each
+// sealed with AES-GCM under a nonce derived from the object's nonce,
+// the segment number, and whether it's the last segment, so objects
+// can be streamed in both directions and truncation is detected.
+package crypt
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Metadata keys describing an encrypted object.
+const (
+	AlgorithmKey = "enc"
+	DataKeyKey   = "enc-key"
+	NonceKey     = "enc-nonce"
+	KeyIDKey     = "enc-kid"
+)
+
+const (
+	algorithm = "aes-256-gcm-stream-64k"
+	segSize   = 64 << 10
+)
+
+// IsMetadata reports whether k is one of the keys used to describe
+// an encrypted object.
+func IsMetadata(k string) bool {
+	switch k {
+	case AlgorithmKey, DataKeyKey, NonceKey, KeyIDKey:
+		return true
+	}
+	return false
+}
+
+// Encrypted reports whether md describes an encrypted object.
+func Encrypted(md map[string]string) bool {
+	return md[AlgorithmKey] != ""
+}
+
+// A MasterKey wraps and unwraps per-object data keys.
+type MasterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// NewMasterKey creates a MasterKey from 32 bytes of key material.
+func NewMasterKey(key []byte) (*MasterKey, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("master key must be 32 bytes, got %v", len(key))
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &MasterKey{id: hex.EncodeToString(sum[:4]), aead: aead}, nil
+}
+
+// LoadMasterKey reads a master key from a file containing either 32
+// raw bytes or their hex encoding.
+func LoadMasterKey(fn string) (*MasterKey, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	if s := strings.TrimSpace(string(b)); len(s) == 64 {
+		if k, err := hex.DecodeString(s); err == nil {
+			b = k
+		}
+	}
+	return NewMasterKey(b)
+}
+
+// ID identifies the master key without revealing it.
+func (m *MasterKey) ID() string {
+	return m.id
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+func (m *MasterKey) wrap(dk []byte) ([]byte, error) {
+	nonce := make([]byte, m.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return m.aead.Seal(nonce, nonce, dk, nil), nil
+}
+
+func (m *MasterKey) unwrap(wrapped []byte) ([]byte, error) {
+	ns := m.aead.NonceSize()
+	if len(wrapped) < ns {
+		return nil, errors.New("wrapped data key too short")
+	}
+	return m.aead.Open(nil, wrapped[:ns], wrapped[ns:], nil)
+}
+
+// EncryptedSize is the size of the ciphertext for n bytes of plaintext.
+func EncryptedSize(n int64) int64 {
+	segs := (n + segSize - 1) / segSize
+	if segs == 0 {
+		segs = 1
+	}
+	return n + segs*16
+}
+
+// Encrypt returns a reader of the ciphertext of r under a fresh data
+// key, along with the metadata needed to decrypt it.
+func (m *MasterKey) Encrypt(r io.Reader) (io.Reader, map[string]string, error) {
+	dk := make([]byte, 32)
+	if _, err := rand.Read(dk); err != nil {
+		return nil, nil, err
+	}
+	aead, err := newAEAD(dk)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := m.wrap(dk)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	md := map[string]string{
+		AlgorithmKey: algorithm,
+		DataKeyKey:   base64.StdEncoding.EncodeToString(wrapped),
+		NonceKey:     base64.StdEncoding.EncodeToString(nonce),
+		KeyIDKey:     m.id,
+	}
+	return &segmenter{src: bufio.NewReaderSize(r, segSize+1), aead: aead, nonce: nonce,
+		in: segSize, seal: true}, md, nil
+}
+
+// Decrypt returns a reader of the plaintext of r, an object encrypted
+// with the given metadata.
+func (m *MasterKey) Decrypt(r io.Reader, md map[string]string) (io.Reader, error) {
+	if md[AlgorithmKey] != algorithm {
+		return nil, fmt.Errorf("unsupported encryption %q", md[AlgorithmKey])
+	}
+	if kid := md[KeyIDKey]; kid != m.id {
+		return nil, fmt.Errorf("object encrypted with master key %v, have %v", kid, m.id)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(md[DataKeyKey])
+	if err != nil {
+		return nil, fmt.Errorf("decoding data key: %v", err)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(md[NonceKey])
+	if err != nil {
+		return nil, fmt.Errorf("decoding nonce: %v", err)
+	}
+	dk, err := m.unwrap(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping data key: %v", err)
+	}
+	aead, err := newAEAD(dk)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce length %v", len(nonce))
+	}
+	return &segmenter{src: bufio.NewReaderSize(r, segSize+17), aead: aead, nonce: nonce,
+		in: segSize + aead.Overhead()}, nil
+}
+
+// segmenter seals or opens a stream one segment at a time.
+type segmenter struct {
+	src   *bufio.Reader
+	aead  cipher.AEAD
+	nonce []byte
+	in    int
+	seal  bool
+
+	n    uint32
+	buf  []byte
+	out  []byte
+	done bool
+}
+
+func (s *segmenter) segmentNonce(last bool) []byte {
+	n := append([]byte{}, s.nonce...)
+	var ctr [4]byte
+	binary.BigEndian.PutUint32(ctr[:], s.n)
+	for i := range ctr {
+		n[len(n)-5+i] ^= ctr[i]
+	}
+	if last {
+		n[len(n)-1] ^= 1
+	}
+	return n
+}
+
+func (s *segmenter) next() error {
+	if s.buf == nil {
+		s.buf = make([]byte, s.in)
+	}
+	n, err := io.ReadFull(s.src, s.buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	last := err != nil
+	if !last {
+		if _, err := s.src.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	nonce := s.segmentNonce(last)
+	if s.seal {
+		s.out = s.aead.Seal(s.out[:0], nonce, s.buf[:n], nil)
+	} else {
+		s.out, err = s.aead.Open(s.out[:0], nonce, s.buf[:n], nil)
+		if err != nil {
+			return fmt.Errorf("decrypting segment %v: %v", s.n, err)
+		}
+	}
+	s.n++
+	s.done = last
+	return nil
+}
+
+func (s *segmenter) Read(p []byte) (int, error) {
+	for len(s.out) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+	return n, nil
+}
@@ -0,0 +1,79 @@
+package crypt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func testKey(t *testing.T) *MasterKey {
+	m, err := NewMasterKey(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestRoundTrip(t *testing.T) {
+	m := testKey(t)
+	for _, size := range []int{0, 1, segSize - 1, segSize, segSize + 1, 3*segSize + 17} {
+		plain := bytes.Repeat([]byte("x"), size)
+		r, md, err := m.Encrypt(bytes.NewReader(plain))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ct, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(ct)) != EncryptedSize(int64(size)) {
+			t.Errorf("size %v: ciphertext is %v bytes, want %v", size, len(ct), EncryptedSize(int64(size)))
+		}
+
+		r, err = m.Decrypt(bytes.NewReader(ct), md)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("size %v: decrypting: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("size %v: round trip produced %v bytes", size, len(got))
+		}
+	}
+}
+
+func TestTampering(t *testing.T) {
+	m := testKey(t)
+	r, md, err := m.Encrypt(bytes.NewReader(bytes.Repeat([]byte("x"), 2*segSize+5)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string][]byte{
+		"truncated": ct[:segSize+16],
+		"flipped":   append(append([]byte{}, ct[:10]...), append([]byte{ct[10] ^ 1}, ct[11:]...)...),
+	}
+	for name, bad := range tests {
+		r, err := m.Decrypt(bytes.NewReader(bad), md)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(r); err == nil {
+			t.Errorf("%v ciphertext decrypted without error", name)
+		}
+	}
+
+	other, err := NewMasterKey(bytes.Repeat([]byte{8}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Decrypt(bytes.NewReader(ct), md); err == nil {
+		t.Errorf("decrypted with the wrong master key")
+	}
+}
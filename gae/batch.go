@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/dustin/reye/crypt"
 	"google.golang.org/api/iterator"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
@@ -26,6 +27,13 @@ const (
 	clipTimeFmt    = "20060102150405"
 	maxSnapAge     = time.Hour
 	snapWarningAge = time.Minute * 25
+
+	// Heartbeats are unhealthy when they're older than this, report
+	// less than minFreePercent free disk or more than maxPendingClips
+	// waiting, or a recent error since the last successful upload.
+	maxHeartbeatAge = time.Minute * 20
+	minFreePercent  = 5
+	maxPendingClips = 50
 )
 
 var localTime *time.Location
@@ -35,6 +43,7 @@ func init() {
 	http.HandleFunc("/batch/scanAll", handleBatchScanAll)
 	http.HandleFunc("/batch/scanSnaps", handleBatchScanSnaps)
 	http.HandleFunc("/batch/expunge", handleBatchExpunge)
+	http.HandleFunc("/batch/checkHeartbeats", handleBatchCheckHeartbeats)
 
 	var err error
 	localTime, err = time.LoadLocation("US/Pacific")
@@ -133,7 +142,13 @@ func handleBatchScanSnaps(w http.ResponseWriter, r *http.Request) {
 			recents[pp[1]] = t
 		}
 
-		if time.Since(t) > maxSnapAge {
+		// The uploader marks the snapshots it keeps as history.
+		expired := time.Since(t) > maxSnapAge
+		if ku, err := time.Parse(time.RFC3339, ob.Metadata["keep_until"]); err == nil {
+			expired = time.Now().After(ku)
+		}
+
+		if expired {
 			deleting++
 			grp.Go(func() error {
 				sem <- true
@@ -188,6 +203,93 @@ func notifyOldCams(ctx context.Context, cams []string, recents map[string]time.T
 	return mail.Send(ctx, msg)
 }
 
+// problems describes whatever's wrong with a heartbeat, or returns ""
+// if it's healthy.
+func (h *Heartbeat) problems(now time.Time) string {
+	var rv []string
+	if age := now.Sub(h.Received); age > maxHeartbeatAge {
+		rv = append(rv, fmt.Sprintf("no heartbeat for %v", age))
+	}
+	if h.TotalBytes > 0 && h.FreeBytes*100/h.TotalBytes < minFreePercent {
+		rv = append(rv, fmt.Sprintf("only %v of %v bytes free", h.FreeBytes, h.TotalBytes))
+	}
+	if h.Pending > maxPendingClips {
+		rv = append(rv, fmt.Sprintf("%v clips pending (%v queued)", h.Pending, h.Queued))
+	}
+	if h.LastErrorAt.After(h.LastUpload) && now.Sub(h.LastErrorAt) < maxHeartbeatAge {
+		rv = append(rv, fmt.Sprintf("error at %v: %v", h.LastErrorAt, h.LastError))
+	}
+	return strings.Join(rv, "; ")
+}
+
+// handleBatchCheckHeartbeats alerts when a camera's uploader has gone
+// quiet or reported something unhealthy, and again when it recovers.
+// Cameras that have never sent a heartbeat are left to the snapshot
+// check.
+func handleBatchCheckHeartbeats(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	var hbs []Heartbeat
+	if err := fillKeyQuery(c, datastore.NewQuery("Heartbeat"), &hbs); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	now := time.Now()
+	changed := map[string]string{}
+	for _, hb := range hbs {
+		p := hb.problems(now)
+		if p == hb.Alert {
+			continue
+		}
+		camid := hb.Key.StringID()
+		log.Infof(c, "Heartbeat for %v changed from %q to %q", camid, hb.Alert, p)
+		changed[camid] = p
+
+		k := hb.Key
+		err := datastore.RunInTransaction(c, func(c context.Context) error {
+			cur := Heartbeat{}
+			if err := datastore.Get(c, k, &cur); err != nil {
+				return err
+			}
+			cur.Alert = p
+			_, err := datastore.Put(c, k, &cur)
+			return err
+		}, nil)
+		if err != nil {
+			log.Errorf(c, "Error recording alert for %v: %v", camid, err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+
+	if len(changed) > 0 {
+		if err := notifyHeartbeats(c, changed); err != nil {
+			log.Errorf(c, "Error sending heartbeat alert: %v", err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+
+	w.WriteHeader(204)
+}
+
+func notifyHeartbeats(ctx context.Context, changed map[string]string) error {
+	buf := &bytes.Buffer{}
+	if err := templates.ExecuteTemplate(buf, "heartbeats.txt", changed); err != nil {
+		return err
+	}
+
+	msg := &mail.Message{
+		Sender:  "Dustin Sallings <dsallings@gmail.com>",
+		To:      []string{"dustin@sallings.org"},
+		Subject: "Camera Health Changed",
+		Body:    string(buf.Bytes()),
+	}
+	log.Infof(ctx, "Sending:\n%s\n", msg.Body)
+	return mail.Send(ctx, msg)
+}
+
 func handleBatchScanAll(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
 	cams, err := loadCameras(c)
@@ -258,6 +360,18 @@ func handleBatchScan(w http.ResponseWriter, r *http.Request) {
 			}
 			evkeys[k.StringID()] = true
 		}
+
+		// Events still processing get filled in once their video shows up.
+		pq := datastore.NewQuery("Event").Filter("status =", statusProcessing).KeysOnly()
+		for it := pq.Run(c); ; {
+			k, err := it.Next(nil)
+			if err == datastore.Done {
+				break
+			} else if err != nil {
+				return err
+			}
+			evkeys[k.StringID()] = false
+		}
 		log.Debugf(c, "Loaded %v events", len(evkeys))
 		return nil
 	})
@@ -302,7 +416,7 @@ func handleBatchScan(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), 500)
 			return
 		}
-		if ob.ContentType == "video/mp4" {
+		if ob.ContentType == "video/mp4" && ob.Metadata["kind"] != "timelapse" {
 			// basement/20161013173815.jpg
 			if err := grp.Wait(); err != nil {
 				log.Errorf(c, "failed to get default GCS bucket name: %v", err)
@@ -316,42 +430,19 @@ func handleBatchScan(w http.ResponseWriter, r *http.Request) {
 				continue
 			}
 			fp := strings.Split(pp[1], ".")
-			t, err := time.Parse(time.RFC3339, ob.Metadata["captured"])
+			ev, err := eventFromVideo(camkey, fp[0], ob.Metadata)
 			if err != nil {
-				t, err = time.ParseInLocation(clipTimeFmt, fp[0], localTime)
-				if err != nil {
-					log.Infof(c, "Failed to parse time in %v: %v", ob.Name, err)
-					continue
-				}
-			}
-
-			dur, err := time.ParseDuration(ob.Metadata["duration"])
-			if err != nil {
-				log.Infof(c, "No duration for %v: %v", fp[0], err)
+				log.Infof(c, "Skipping %v: %v", ob.Name, err)
 				continue
 			}
-			var md []struct{ K, V string }
-			for k, v := range ob.Metadata {
-				switch k {
-				case "", "camera", "captured", "duration":
-				default:
-					md = append(md, struct{ K, V string }{k, v})
-				}
-			}
 
 			evkey := datastore.NewKey(c, "Event", pp[0]+"/"+fp[0], 0, nil)
 
 			if !evkeys[evkey.StringID()] {
-				log.Debugf(c, "Adding %v in %v: %v", fp[0], camkey, t)
+				log.Debugf(c, "Adding %v in %v: %v", fp[0], camkey, ev.Timestamp)
 
 				keystodo = append(keystodo, evkey)
-				valstodo = append(valstodo, &Event{
-					Camera:    camkey,
-					Timestamp: t,
-					Filename:  fp[0],
-					Duration:  dur,
-					Metadata:  md,
-				})
+				valstodo = append(valstodo, ev)
 				todo++
 			}
 		}
@@ -385,6 +476,39 @@ func handleBatchScan(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(204)
 }
 
+// eventFromVideo is the complete event for the video named id (less its
+// camera and extension) with the given object metadata.
+func eventFromVideo(camkey *datastore.Key, id string, metadata map[string]string) (*Event, error) {
+	t, err := time.Parse(time.RFC3339, metadata["captured"])
+	if err != nil {
+		t, err = time.ParseInLocation(clipTimeFmt, id, localTime)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse time: %v", err)
+		}
+	}
+
+	dur, err := time.ParseDuration(metadata["duration"])
+	if err != nil {
+		return nil, fmt.Errorf("no duration: %v", err)
+	}
+	var md []struct{ K, V string }
+	for k, v := range metadata {
+		switch {
+		case k == "", k == "camera", k == "captured", k == "duration", k == "md5", k == "crc32c":
+		case crypt.IsMetadata(k):
+		default:
+			md = append(md, struct{ K, V string }{k, v})
+		}
+	}
+	return &Event{
+		Camera:    camkey,
+		Timestamp: t,
+		Filename:  id,
+		Duration:  dur,
+		Metadata:  md,
+	}, nil
+}
+
 func handleBatchExpunge(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
 
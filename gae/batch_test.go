@@ -0,0 +1,41 @@
+package scenic
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPendingEventCompletedByScan(t *testing.T) {
+	// What addPendingEvent stores when the thumbnail's up.
+	ev := Event{Filename: "20170518102400", Timestamp: time.Date(2017, 5, 18, 10, 24, 0, 0, time.UTC),
+		Status: statusProcessing}
+
+	if !ev.complete(10 * time.Second) {
+		t.Fatalf("pending event wasn't completed")
+	}
+	// The scan only rewrites events that are still processing.
+	if ev.Status != statusProcessing || ev.Duration != 10*time.Second {
+		t.Fatalf("completed event = %+v, want it processing until it's scanned", ev)
+	}
+
+	scanned, err := eventFromVideo(nil, ev.Filename, map[string]string{
+		"captured": "2017-05-18T10:24:00Z",
+		"duration": "10s",
+		"camera":   "porch",
+		"frame":    "03",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scanned.Status != "" || scanned.Duration != 10*time.Second || !scanned.Timestamp.Equal(ev.Timestamp) ||
+		len(scanned.Metadata) != 1 || scanned.Metadata[0].K != "frame" {
+		t.Errorf("scanned event = %+v", scanned)
+	}
+	if scanned.complete(time.Second) || scanned.Duration != 10*time.Second {
+		t.Errorf("a late completion changed the scanned event: %+v", scanned)
+	}
+
+	if _, err := eventFromVideo(nil, ev.Filename, map[string]string{}); err == nil {
+		t.Errorf("a video without a duration made an event")
+	}
+}
@@ -2,7 +2,9 @@ package scenic
 
 import (
 	"encoding/json"
+	"fmt"
 	"reflect"
+	"strings"
 	"time"
 
 	"context"
@@ -16,6 +18,12 @@ import (
 type Camera struct {
 	Name string `json:"name" datastore:"name"`
 
+	// A paused camera's uploader doesn't publish anything, and neither
+	// does any camera during its pause schedule: a comma separated list
+	// of local time windows, e.g. 22:00-07:00,12:00-13:00.
+	Paused        bool   `json:"paused" datastore:"paused,noindex"`
+	PauseSchedule string `json:"pause_schedule" datastore:"pause_schedule,noindex"`
+
 	Key *datastore.Key `datastore:"-"`
 }
 
@@ -26,13 +34,110 @@ func (c *Camera) setKey(to *datastore.Key) {
 // MarshalJSON JSONifies cameras.
 func (c Camera) MarshalJSON() ([]byte, error) {
 	m := map[string]interface{}{
-		"name":  c.Name,
-		"key":   c.Key.Encode(),
-		"keyid": c.Key.StringID(),
+		"name":           c.Name,
+		"key":            c.Key.Encode(),
+		"keyid":          c.Key.StringID(),
+		"paused":         c.Paused,
+		"pause_schedule": c.PauseSchedule,
+		"paused_now":     c.pausedAt(time.Now()),
+		"pause_timezone": localTime.String(),
 	}
 	return json.Marshal(m)
 }
 
+// pausedAt reports whether the camera is paused at t, either by hand
+// or by its schedule.
+func (c Camera) pausedAt(t time.Time) bool {
+	if c.Paused {
+		return true
+	}
+	ws, err := parsePauseSchedule(c.PauseSchedule)
+	if err != nil {
+		// It was checked when it was set.
+		return false
+	}
+	t = t.In(localTime)
+	tod := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	for _, w := range ws {
+		if w[0] <= w[1] && tod >= w[0] && tod < w[1] ||
+			w[0] > w[1] && (tod >= w[0] || tod < w[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePauseSchedule parses a pause schedule into the start and end
+// times of day of each of its windows.
+func parsePauseSchedule(s string) ([][2]time.Duration, error) {
+	var rv [][2]time.Duration
+	for _, ws := range strings.Split(s, ",") {
+		ws = strings.TrimSpace(ws)
+		if ws == "" {
+			continue
+		}
+		a := strings.Split(ws, "-")
+		if len(a) != 2 {
+			return nil, fmt.Errorf("invalid window %q, want HH:MM-HH:MM", ws)
+		}
+		var w [2]time.Duration
+		for i, ts := range a {
+			t, err := time.Parse("15:04", ts)
+			if err != nil {
+				return nil, fmt.Errorf("invalid window %q: %v", ws, err)
+			}
+			w[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+		}
+		rv = append(rv, w)
+	}
+	return rv, nil
+}
+
+// A CameraConfig is the part of a camera's config its uploader takes
+// from us, stored under the camera's key name.  Zero values leave the
+// uploader's own settings alone.  The version goes up with every
+// change, so uploaders only need the ones they don't have.
+type CameraConfig struct {
+	Version         int           `json:"version" datastore:"version,noindex"`
+	DeleteDays      int           `json:"delete_days,omitempty" datastore:"delete_days,noindex"`
+	TriggerURL      string        `json:"trigger_url,omitempty" datastore:"trigger_url,noindex"`
+	SnapshotTimeout time.Duration `json:"snapshot_timeout,omitempty" datastore:"snapshot_timeout,noindex"`
+	Updated         time.Time     `json:"updated" datastore:"updated,noindex"`
+}
+
+// A Heartbeat is the latest report of health from a camera's uploader.
+// It's stored under the camera's key name.
+type Heartbeat struct {
+	Camera      *datastore.Key `json:"-" datastore:"camera"`
+	CameraID    string         `json:"camera" datastore:"-"`
+	Received    time.Time      `json:"received" datastore:"received"`
+	Sent        time.Time      `json:"sent" datastore:"sent,noindex"`
+	Version     string         `json:"version" datastore:"version,noindex"`
+	Host        string         `json:"host" datastore:"host,noindex"`
+	FreeBytes   int64          `json:"free_bytes" datastore:"free_bytes,noindex"`
+	TotalBytes  int64          `json:"total_bytes" datastore:"total_bytes,noindex"`
+	Pending     int            `json:"pending" datastore:"pending,noindex"`
+	Queued      int            `json:"queued" datastore:"queued,noindex"`
+	LastError   string         `json:"last_error,omitempty" datastore:"last_error,noindex"`
+	LastErrorAt time.Time      `json:"last_error_at" datastore:"last_error_at,noindex"`
+	LastUpload  time.Time      `json:"last_upload" datastore:"last_upload,noindex"`
+
+	// The problems we last sent an alert about, if any.
+	Alert string `json:"alert,omitempty" datastore:"alert,noindex"`
+
+	Key *datastore.Key `json:"-" datastore:"-"`
+}
+
+func (h *Heartbeat) setKey(to *datastore.Key) {
+	h.Key = to
+}
+
+// Event statuses.  Events are complete (with no status) once their
+// video is available.
+const (
+	statusProcessing = "processing"
+)
+
 // An Event represents all of the details of a time when motion was detected.
 type Event struct {
 	Camera    *datastore.Key          `json:"cam_id" datastore:"camera"`
@@ -40,6 +145,7 @@ type Event struct {
 	Filename  string                  `json:"fn" datastore:"fn"`
 	Duration  time.Duration           `json:"duration"`
 	Metadata  []struct{ K, V string } `json:"metadata"`
+	Status    string                  `json:"status,omitempty" datastore:"status"`
 
 	Key *datastore.Key `datastore:"-"`
 }
@@ -48,6 +154,17 @@ func (u *Event) setKey(to *datastore.Key) {
 	u.Key = to
 }
 
+// complete notes the duration of a pending event's video, reporting
+// whether the event changed.  It's left processing: only the scan
+// clears that, once it's filled the event in from the video.
+func (u *Event) complete(dur time.Duration) bool {
+	if u.Status != statusProcessing {
+		return false
+	}
+	u.Duration = dur
+	return true
+}
+
 // Keyable entities can have their keys set via fillKeyQuery
 type Keyable interface {
 	setKey(*datastore.Key)
@@ -5,10 +5,39 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"net/url"
 	"reflect"
 	"strings"
 )
 
+// sameOrigin reports whether a request came from one of our own pages,
+// as far as the browser says.  Anything that changes state from the web
+// app checks this so other sites can't forge requests with a user's
+// cookies.
+func sameOrigin(r *http.Request) bool {
+	src := r.Header.Get("Origin")
+	if src == "" {
+		src = r.Header.Get("Referer")
+	}
+	if src == "" {
+		return false
+	}
+	u, err := url.Parse(src)
+	return err == nil && u.Host == r.Host
+}
+
+// sameOriginPosts rejects POSTs to h that didn't come from one of our
+// own pages.
+func sameOriginPosts(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" && !sameOrigin(r) {
+			http.Error(w, "cross-site request", 403)
+			return
+		}
+		h(w, r)
+	}
+}
+
 func canGzip(req *http.Request) bool {
 	acceptable := req.Header.Get("accept-encoding")
 	return strings.Contains(acceptable, "gzip")
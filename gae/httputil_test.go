@@ -0,0 +1,56 @@
+package scenic
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSameOrigin(t *testing.T) {
+	for _, test := range []struct {
+		origin, referer string
+		want            bool
+	}{
+		{"https://example.com", "", true},
+		{"", "https://example.com/eye/", true},
+		{"https://evil.example", "https://example.com/eye/", false},
+		{"", "https://evil.example/example.com", false},
+		{"", "", false},
+	} {
+		r := httptest.NewRequest("POST", "https://example.com/api/setPause?cam=porch&paused=true", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if test.referer != "" {
+			r.Header.Set("Referer", test.referer)
+		}
+		if got := sameOrigin(r); got != test.want {
+			t.Errorf("sameOrigin(origin %q, referer %q) = %v, want %v", test.origin, test.referer, got, test.want)
+		}
+	}
+}
+
+func TestSameOriginPosts(t *testing.T) {
+	called := false
+	h := sameOriginPosts(func(w http.ResponseWriter, r *http.Request) { called = true })
+	for _, test := range []struct {
+		method, origin string
+		want           int
+	}{
+		{"POST", "https://evil.example", 403},
+		{"POST", "", 403},
+		{"POST", "https://example.com", 200},
+		{"GET", "https://evil.example", 200},
+	} {
+		called = false
+		r := httptest.NewRequest(test.method, "https://example.com/admin/config?cam=porch&trigger_url=x", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != test.want || called != (test.want == 200) {
+			t.Errorf("%v from %q = %v (handled: %v), want %v", test.method, test.origin, w.Code, called, test.want)
+		}
+	}
+}
@@ -121,6 +121,33 @@ function homeController($scope, $http, $interval) {
         $scope.cams = data;
     });
 
+    var setPause = function(cam, params) {
+        var q = "cam=" + encodeURIComponent(cam.keyid);
+        for (var k in params) {
+            q += "&" + k + "=" + encodeURIComponent(params[k]);
+        }
+        $http.post("/api/setPause?" + q).success(function(data) {
+            for (var k in data) {
+                cam[k] = data[k];
+            }
+        }).error(function(data) {
+            alert("Couldn't update " + cam.name + ": " + data);
+        });
+    };
+
+    $scope.togglePause = function(cam) {
+        setPause(cam, {paused: !cam.paused});
+    };
+
+    $scope.editSchedule = function(cam) {
+        var sched = prompt("Pause " + cam.name + " during (" + cam.pause_timezone +
+                           " time, e.g. 22:00-07:00,12:00-13:00):",
+                           cam.pause_schedule);
+        if (sched !== null) {
+            setPause(cam, {schedule: sched});
+        }
+    };
+
     $scope.camchange = function() {
         console.log("Cam is now", $scope.cam ? $scope.cam : 'All');
         cursor = '';
@@ -132,6 +159,9 @@ function homeController($scope, $http, $interval) {
     $scope.scaled = function(i) {
         var bw = 320;
         var bh = 240;
+        if (i.status == "processing") {
+            return {w: bw / 2, h: bh / 2};
+        }
         var scale = Math.max(.1, Math.log(i.duration / 1000000000) / 8.2);
         return {w: Math.round(bw * scale), h: Math.round(bh * scale)};
     };
@@ -142,6 +172,9 @@ function homeController($scope, $http, $interval) {
     };
 
     $scope.play = function(which) {
+        if (which.status == "processing") {
+            return;
+        }
         var url = $scope.base + which.Camera.keyid + "/" + which.fn + ".mp4";
         $scope.videosrc = url;
         var video = document.getElementById("player");
@@ -1,24 +1,31 @@
 package scenic
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"html/template"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"reflect"
+	"strconv"
 	"time"
 
 	"context"
+	"github.com/dustin/reye/sign"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
 	"google.golang.org/appengine/taskqueue"
 )
 
 const (
-	authHdrKey = "x-reye"
+	// How far an uploader's clock may be from ours.
+	maxTriggerSkew = 5 * time.Minute
 )
 
 var (
@@ -35,6 +42,11 @@ func init() {
 	http.HandleFunc("/api/recentImages", handleRecentImages)
 	http.HandleFunc("/api/cams", handleCams)
 	http.HandleFunc("/api/newfile", handleNewFile)
+	http.HandleFunc("/api/heartbeat", handleHeartbeat)
+	http.HandleFunc("/api/pause", handlePause)
+	http.HandleFunc("/api/setPause", handleSetPause)
+	http.HandleFunc("/api/config", handleConfig)
+	http.HandleFunc("/admin/config", sameOriginPosts(handleAdminConfig))
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/eye/", http.StatusFound)
@@ -163,13 +175,30 @@ func handleCams(w http.ResponseWriter, r *http.Request) {
 func handleNewFile(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
 
-	if r.Header.Get(authHdrKey) != os.Getenv("BATCH_AUTH") {
+	if err := verifyUploader(c, r); err != nil {
+		log.Warningf(c, "Rejecting trigger: %v", err)
 		http.Error(w, "auth fail", 401)
 		return
 	}
 
 	cam := r.FormValue("cam")
-	log.Debugf(c, "Notification for %v", cam)
+	log.Debugf(c, "Notification for %v (%v)", cam, r.FormValue("status"))
+
+	switch r.FormValue("status") {
+	case "pending":
+		// Just the thumbnail so far; show it while the video's on its way.
+		if err := addPendingEvent(c, cam, r.FormValue("id"), r.FormValue("captured")); err != nil {
+			log.Warningf(c, "Error adding pending event %v/%v: %v", cam, r.FormValue("id"), err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.WriteHeader(201)
+		return
+	case "complete":
+		if err := completeEvent(c, cam, r.FormValue("id"), r.FormValue("duration")); err != nil {
+			log.Warningf(c, "Error completing event %v/%v: %v", cam, r.FormValue("id"), err)
+		}
+	}
 
 	if _, err := taskqueue.Add(c, taskqueue.NewPOSTTask("/batch/scan", url.Values{"subdir": []string{cam}}), ""); err != nil {
 		log.Warningf(c, "Error queue task for batch scan: %v", err)
@@ -177,3 +206,383 @@ func handleNewFile(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(201)
 }
+
+// addPendingEvent records an event whose video isn't available yet.
+func addPendingEvent(c context.Context, cam, id, captured string) error {
+	cams, err := loadCameras(c)
+	if err != nil {
+		return err
+	}
+	camera, ok := cams[cam]
+	if !ok {
+		return fmt.Errorf("unknown camera %q", cam)
+	}
+	t, err := time.Parse(time.RFC3339, captured)
+	if err != nil {
+		if t, err = time.ParseInLocation(clipTimeFmt, id, localTime); err != nil {
+			return fmt.Errorf("invalid event id %q: %v", id, err)
+		}
+	}
+
+	k := datastore.NewKey(c, "Event", cam+"/"+id, 0, nil)
+	return datastore.RunInTransaction(c, func(c context.Context) error {
+		if err := datastore.Get(c, k, &Event{}); err != datastore.ErrNoSuchEntity {
+			// Already there (possibly complete), or we can't tell.
+			return err
+		}
+		_, err := datastore.Put(c, k, &Event{
+			Camera:    camera.Key,
+			Timestamp: t,
+			Filename:  id,
+			Status:    statusProcessing,
+		})
+		return err
+	}, nil)
+}
+
+// completeEvent records the duration of a pending event's video.  The
+// event stays processing so the scan that follows rewrites it with the
+// video's metadata (and creates it if we never heard it was pending).
+func completeEvent(c context.Context, cam, id, duration string) error {
+	dur, err := time.ParseDuration(duration)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %v", duration, err)
+	}
+	k := datastore.NewKey(c, "Event", cam+"/"+id, 0, nil)
+	return datastore.RunInTransaction(c, func(c context.Context) error {
+		ev := Event{}
+		if err := datastore.Get(c, k, &ev); err == datastore.ErrNoSuchEntity {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !ev.complete(dur) {
+			return nil
+		}
+		_, err := datastore.Put(c, k, &ev)
+		return err
+	}, nil)
+}
+
+// verifyUploader checks a request was signed by an uploader with one of
+// the keys in TRIGGER_KEYS (a comma separated list of id:secret), and
+// hasn't been seen before.  The body is left in place for the handler.
+//
+// Nonces are remembered in memcache, which may evict them, so replay
+// protection is best effort: a request captured within the clock skew
+// could be replayed against the same endpoint.  Everything uploaders
+// send is safe to repeat (events are created idempotently, heartbeats
+// are overwritten, and the rest only reads).
+func verifyUploader(c context.Context, r *http.Request) error {
+	keys, err := sign.ParseKeys(os.Getenv("TRIGGER_KEYS"))
+	if err != nil {
+		return fmt.Errorf("parsing TRIGGER_KEYS: %v", err)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	v := &sign.Verifier{
+		Keys:    keys,
+		MaxSkew: maxTriggerSkew,
+		Seen: func(nonce string, ttl time.Duration) error {
+			err := memcache.Add(c, &memcache.Item{Key: "nonce:" + nonce, Value: []byte{1}, Expiration: ttl})
+			if err == memcache.ErrNotStored {
+				return sign.ErrReplay
+			}
+			return err
+		},
+	}
+	return v.Verify(r, body, time.Now())
+}
+
+// handleHeartbeat stores the latest health reported by an uploader for
+// each of its cameras.
+func handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if err := verifyUploader(c, r); err != nil {
+		log.Warningf(c, "Rejecting heartbeat: %v", err)
+		http.Error(w, "auth fail", 401)
+		return
+	}
+
+	var hbs []Heartbeat
+	if err := json.NewDecoder(r.Body).Decode(&hbs); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	cams, err := loadCameras(c)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	now := time.Now()
+	for _, hb := range hbs {
+		hb := hb
+		camid := hb.CameraID
+		camera, ok := cams[camid]
+		if !ok {
+			log.Warningf(c, "Heartbeat for unknown camera %q", camid)
+			continue
+		}
+		hb.Camera, hb.Received = camera.Key, now
+		k := datastore.NewKey(c, "Heartbeat", camid, 0, nil)
+		err := datastore.RunInTransaction(c, func(c context.Context) error {
+			prev := Heartbeat{}
+			if err := datastore.Get(c, k, &prev); err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			hb.Alert = prev.Alert
+			_, err := datastore.Put(c, k, &hb)
+			return err
+		}, nil)
+		if err != nil {
+			log.Errorf(c, "Error storing heartbeat for %v: %v", camid, err)
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+
+	w.WriteHeader(204)
+}
+
+// pauseState is how a camera's pause state is sent to its uploader.
+// The schedule's in our timezone, which is sent along so both ends
+// agree on when it applies.
+type pauseState struct {
+	Paused   bool   `json:"paused"`
+	Schedule string `json:"schedule,omitempty"`
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// handlePause tells an uploader which of its cameras (named by a JSON
+// list of ids) are paused.  Schedules are evaluated by the uploader, so
+// it can keep to them when it can't reach us.
+func handlePause(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if err := verifyUploader(c, r); err != nil {
+		log.Warningf(c, "Rejecting pause check: %v", err)
+		http.Error(w, "auth fail", 401)
+		return
+	}
+
+	var ids []string
+	if err := json.NewDecoder(r.Body).Decode(&ids); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	cams, err := loadCameras(c)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	rv := map[string]pauseState{}
+	for _, id := range ids {
+		if cam, ok := cams[id]; ok {
+			rv[id] = pauseState{cam.Paused, cam.PauseSchedule, localTime.String()}
+		}
+	}
+	mustEncode(c, w, r, rv)
+}
+
+// handleSetPause pauses or resumes a camera, and/or sets its pause
+// schedule, from the web app.
+func handleSetPause(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if r.Method != "POST" {
+		http.Error(w, "POST only", 405)
+		return
+	}
+	if !sameOrigin(r) {
+		log.Warningf(c, "Rejecting cross-site pause change (origin %q, referer %q)",
+			r.Header.Get("Origin"), r.Header.Get("Referer"))
+		http.Error(w, "cross-site request", 403)
+		return
+	}
+
+	var paused *bool
+	if ps := r.FormValue("paused"); ps != "" {
+		p, err := strconv.ParseBool(ps)
+		if err != nil {
+			http.Error(w, "invalid paused value: "+err.Error(), 400)
+			return
+		}
+		paused = &p
+	}
+	sched, setSched := r.Form["schedule"]
+	if setSched {
+		if _, err := parsePauseSchedule(sched[0]); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	}
+
+	k := datastore.NewKey(c, "Camera", r.FormValue("cam"), 0, nil)
+	cam := &Camera{}
+	err := datastore.RunInTransaction(c, func(c context.Context) error {
+		if err := datastore.Get(c, k, cam); err != nil {
+			return err
+		}
+		if paused != nil {
+			cam.Paused = *paused
+		}
+		if setSched {
+			cam.PauseSchedule = sched[0]
+		}
+		_, err := datastore.Put(c, k, cam)
+		return err
+	}, nil)
+	if err == datastore.ErrNoSuchEntity {
+		http.Error(w, "no such camera", 404)
+		return
+	} else if err != nil {
+		log.Errorf(c, "Error updating pause state of %v: %v", k.StringID(), err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	memcache.Delete(c, camsKey)
+	log.Infof(c, "Camera %v paused=%v, schedule=%q", k.StringID(), cam.Paused, cam.PauseSchedule)
+
+	cam.setKey(k)
+	mustEncode(c, w, r, cam)
+}
+
+// handleConfig sends an uploader the config of each of its cameras
+// whose version differs from the one it has (a JSON object of camera id
+// to version).
+func handleConfig(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	if err := verifyUploader(c, r); err != nil {
+		log.Warningf(c, "Rejecting config fetch: %v", err)
+		http.Error(w, "auth fail", 401)
+		return
+	}
+
+	have := map[string]int{}
+	if err := json.NewDecoder(r.Body).Decode(&have); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	var ids []string
+	var keys []*datastore.Key
+	for id := range have {
+		ids = append(ids, id)
+		keys = append(keys, datastore.NewKey(c, "CameraConfig", id, 0, nil))
+	}
+	confs := make([]CameraConfig, len(keys))
+	err := datastore.GetMulti(c, keys, confs)
+	errs, _ := err.(appengine.MultiError)
+	if err != nil && errs == nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	rv := map[string]CameraConfig{}
+	for i, id := range ids {
+		if errs != nil && errs[i] == datastore.ErrNoSuchEntity {
+			continue
+		} else if errs != nil && errs[i] != nil {
+			http.Error(w, errs[i].Error(), 500)
+			return
+		}
+		if confs[i].Version != have[id] {
+			rv[id] = confs[i]
+		}
+	}
+	mustEncode(c, w, r, rv)
+}
+
+// handleAdminConfig shows (GET) or changes (POST) a camera's config.
+// Only the fields given are changed; empty values go back to the
+// uploader's own settings.  Changes have to come from our own pages
+// (see sameOriginPosts).
+func handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+
+	cams, err := loadCameras(c)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	camid := r.FormValue("cam")
+	if _, ok := cams[camid]; !ok {
+		http.Error(w, "no such camera", 404)
+		return
+	}
+	k := datastore.NewKey(c, "CameraConfig", camid, 0, nil)
+
+	if r.Method != "POST" {
+		conf := CameraConfig{}
+		if err := datastore.Get(c, k, &conf); err != nil && err != datastore.ErrNoSuchEntity {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		mustEncode(c, w, r, conf)
+		return
+	}
+
+	var changes []func(*CameraConfig)
+	if _, ok := r.Form["delete_days"]; ok {
+		days := 0
+		if v := r.FormValue("delete_days"); v != "" {
+			if days, err = strconv.Atoi(v); err != nil || days < 0 {
+				http.Error(w, fmt.Sprintf("invalid delete_days %q", v), 400)
+				return
+			}
+		}
+		changes = append(changes, func(conf *CameraConfig) { conf.DeleteDays = days })
+	}
+	if _, ok := r.Form["trigger_url"]; ok {
+		u := r.FormValue("trigger_url")
+		if u != "" {
+			if pu, err := url.Parse(u); err != nil || !pu.IsAbs() {
+				http.Error(w, fmt.Sprintf("invalid trigger_url %q", u), 400)
+				return
+			}
+		}
+		changes = append(changes, func(conf *CameraConfig) { conf.TriggerURL = u })
+	}
+	if _, ok := r.Form["snapshot_timeout"]; ok {
+		var d time.Duration
+		if v := r.FormValue("snapshot_timeout"); v != "" {
+			if d, err = time.ParseDuration(v); err != nil || d < 0 {
+				http.Error(w, fmt.Sprintf("invalid snapshot_timeout %q", v), 400)
+				return
+			}
+		}
+		changes = append(changes, func(conf *CameraConfig) { conf.SnapshotTimeout = d })
+	}
+
+	conf := CameraConfig{}
+	err = datastore.RunInTransaction(c, func(c context.Context) error {
+		conf = CameraConfig{}
+		if err := datastore.Get(c, k, &conf); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		for _, f := range changes {
+			f(&conf)
+		}
+		conf.Version++
+		conf.Updated = time.Now()
+		_, err := datastore.Put(c, k, &conf)
+		return err
+	}, nil)
+	if err != nil {
+		log.Errorf(c, "Error updating config of %v: %v", camid, err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	log.Infof(c, "Camera %v config is now version %v: %+v", camid, conf.Version, conf)
+	mustEncode(c, w, r, conf)
+}
@@ -0,0 +1,95 @@
+// Package logging sets up structured logs for reye's commands, and
+// carries the logger for whatever's being worked on (e.g. one clip)
+// through contexts so everything done for it, down to ffmpeg's
+// complaints, can be found together.
+package logging
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"log/syslog"
+	"os"
+)
+
+var (
+	format = flag.String("log_format", "text", "log format: text or json")
+	debug  = flag.Bool("log_debug", false, "include debug logs")
+)
+
+// Common attribute keys.
+const (
+	Camera = "camera"
+	Clip   = "clip"
+	Phase  = "phase"
+	Bytes  = "bytes"
+	Object = "object"
+	Tool   = "tool"
+	Stderr = "stderr"
+)
+
+// Setup makes the logs go to w (or syslog, tagged with the given name,
+// if w is nil) in the -log_format format.  The standard log package
+// writes through it, too.
+func Setup(name string, w io.Writer) error {
+	opts := &slog.HandlerOptions{Level: slog.LevelInfo}
+	if *debug {
+		opts.Level = slog.LevelDebug
+	}
+	if w == nil {
+		sl, err := syslog.New(syslog.LOG_INFO, name)
+		if err != nil {
+			return err
+		}
+		w = sl
+		// syslog has its own timestamps.
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		}
+	}
+
+	var h slog.Handler
+	switch *format {
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown -log_format %q", *format)
+	}
+	slog.SetDefault(slog.New(h))
+	log.SetFlags(0)
+	return nil
+}
+
+// MustSetup is Setup for main, logging to stderr or syslog.
+func MustSetup(name string, toSyslog bool) {
+	var w io.Writer = os.Stderr
+	if toSyslog {
+		w = nil
+	}
+	if err := Setup(name, w); err != nil {
+		log.Fatalf("Can't initialize logging: %v", err)
+	}
+}
+
+type ctxKey struct{}
+
+// With returns a context carrying l.
+func With(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, l)
+}
+
+// From returns the logger carried by ctx, or the default one.
+func From(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(ctxKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
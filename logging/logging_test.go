@@ -0,0 +1,46 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"testing"
+)
+
+func TestJSONContextLogger(t *testing.T) {
+	old := *format
+	defer func() { *format = old }()
+	*format = "json"
+
+	buf := &bytes.Buffer{}
+	if err := Setup("test", buf); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := With(context.Background(), From(context.Background()).With(Camera, "porch", Clip, "20170518102400"))
+	From(ctx).Info("uploaded", Phase, "upload", Bytes, 1234)
+
+	var rec map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("decoding %q: %v", buf, err)
+	}
+	for k, v := range map[string]interface{}{
+		"msg": "uploaded", Camera: "porch", Clip: "20170518102400", Phase: "upload", Bytes: 1234.0,
+	} {
+		if rec[k] != v {
+			t.Errorf("%v = %v, want %v", k, rec[k], v)
+		}
+	}
+
+	buf.Reset()
+	log.Printf("plain %v", 1)
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil || rec["msg"] != "plain 1" {
+		t.Errorf("standard log = %q, %v", buf, err)
+	}
+
+	*format = "xml"
+	if err := Setup("test", buf); err == nil {
+		t.Errorf("Setup with an unknown format didn't fail")
+	}
+}
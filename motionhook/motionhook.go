@@ -0,0 +1,48 @@
+// Command motionhook passes motion's event hooks along to a running
+// uploader so it can upload clips as soon as they're finished, e.g.:
+//
+//	on_movie_end /usr/local/bin/motionhook -camera porch -event %v %f
+//	on_event_end /usr/local/bin/motionhook -camera porch -event %v
+//
+// The uploader's periodic scan picks up anything that doesn't make it.
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	hookURL = flag.String("url", "http://localhost:8080/hook", "uploader hook URL")
+	camID   = flag.String("camera", "", "camera id (may be omitted if the uploader has only one camera)")
+	event   = flag.String("event", "", "motion event number")
+	timeout = flag.Duration("timeout", 10*time.Second, "how long to wait for the uploader")
+)
+
+func main() {
+	flag.Parse()
+
+	v := url.Values{"file": flag.Args()}
+	if *camID != "" {
+		v.Set("camera", *camID)
+	}
+	if *event != "" {
+		v.Set("event", *event)
+	}
+
+	hc := &http.Client{Timeout: *timeout}
+	res, err := hc.PostForm(*hookURL, v)
+	if err != nil {
+		log.Fatalf("Error notifying uploader: %v", err)
+	}
+	defer res.Body.Close()
+	b, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode >= 300 {
+		log.Fatalf("Uploader said %v: %s", res.Status, strings.TrimSpace(string(b)))
+	}
+}
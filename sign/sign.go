@@ -0,0 +1,147 @@
+// Package sign implements the HMAC signatures the uploader puts on its
+// requests to the app.
+//
+// A signature covers the request's method, path and body, a timestamp
+// and a random nonce, so a captured request can't be altered or sent
+// to another endpoint, and can only be replayed within the allowed
+// clock skew, which the verifier closes by remembering nonces (as well
+// as its Seen does).  Keys are named so several can be accepted at once
+// while secrets are being rotated.
+package sign
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers carrying a request's signature.
+const (
+	KeyIDHeader     = "x-reye-key"
+	TimestampHeader = "x-reye-timestamp"
+	NonceHeader     = "x-reye-nonce"
+	SignatureHeader = "x-reye-signature"
+)
+
+// Errors returned by Verify.
+var (
+	ErrUnsigned     = errors.New("request is not signed")
+	ErrUnknownKey   = errors.New("unknown signing key")
+	ErrBadSignature = errors.New("bad signature")
+	ErrSkew         = errors.New("timestamp outside the allowed clock skew")
+	ErrReplay       = errors.New("nonce has already been used")
+)
+
+// A Key is a named signing secret.
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// ParseKey parses a key written as id:secret.
+func ParseKey(s string) (Key, error) {
+	parts := strings.SplitN(strings.TrimSpace(s), ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return Key{}, fmt.Errorf("signing key must look like id:secret")
+	}
+	return Key{ID: parts[0], Secret: []byte(parts[1])}, nil
+}
+
+// ParseKeys parses a comma separated list of id:secret keys.
+func ParseKeys(s string) ([]Key, error) {
+	var rv []Key
+	for _, ks := range strings.Split(s, ",") {
+		if strings.TrimSpace(ks) == "" {
+			continue
+		}
+		k, err := ParseKey(ks)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, k)
+	}
+	return rv, nil
+}
+
+func mac(secret []byte, r *http.Request, ts, nonce string, body []byte) []byte {
+	path := r.URL.Path
+	if path == "" {
+		// That's how it looks to the server.
+		path = "/"
+	}
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(r.Method + "\n" + path + "\n" + ts + "\n" + nonce + "\n"))
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// Sign adds the signature headers for req, whose body is body.
+func Sign(req *http.Request, body []byte, k Key, now time.Time) error {
+	nb := make([]byte, 16)
+	if _, err := rand.Read(nb); err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(now.Unix(), 10)
+	nonce := hex.EncodeToString(nb)
+	h := req.Header
+	h.Set(KeyIDHeader, k.ID)
+	h.Set(TimestampHeader, ts)
+	h.Set(NonceHeader, nonce)
+	h.Set(SignatureHeader, hex.EncodeToString(mac(k.Secret, req, ts, nonce, body)))
+	return nil
+}
+
+// A Verifier checks signed requests.
+type Verifier struct {
+	Keys []Key
+	// MaxSkew is how far a request's timestamp may be from now.
+	MaxSkew time.Duration
+	// Seen records a nonce, returning ErrReplay if it has been seen
+	// before.  Nonces only need to be remembered for ttl.  Replays are
+	// only caught as reliably as Seen remembers.
+	Seen func(nonce string, ttl time.Duration) error
+}
+
+// Verify checks the signature on r, whose body is body.
+func (v *Verifier) Verify(r *http.Request, body []byte, now time.Time) error {
+	h := r.Header
+	kid, ts, nonce, sig := h.Get(KeyIDHeader), h.Get(TimestampHeader), h.Get(NonceHeader), h.Get(SignatureHeader)
+	if kid == "" || ts == "" || nonce == "" || sig == "" {
+		return ErrUnsigned
+	}
+
+	var key *Key
+	for i := range v.Keys {
+		if v.Keys[i].ID == kid {
+			key = &v.Keys[i]
+		}
+	}
+	if key == nil {
+		return ErrUnknownKey
+	}
+
+	got, err := hex.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, mac(key.Secret, r, ts, nonce, body)) {
+		return ErrBadSignature
+	}
+
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrBadSignature
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > v.MaxSkew || d < -v.MaxSkew {
+		return ErrSkew
+	}
+
+	if v.Seen != nil {
+		return v.Seen(kid+":"+nonce, 2*v.MaxSkew)
+	}
+	return nil
+}
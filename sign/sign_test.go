@@ -0,0 +1,93 @@
+package sign
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	old, _ := ParseKey("old:hunter2")
+	cur, _ := ParseKey("new:correct horse")
+	seen := map[string]bool{}
+	v := &Verifier{
+		Keys:    []Key{old, cur},
+		MaxSkew: 5 * time.Minute,
+		Seen: func(n string, ttl time.Duration) error {
+			if seen[n] {
+				return ErrReplay
+			}
+			seen[n] = true
+			return nil
+		},
+	}
+	now := time.Now()
+	body := []byte("cam=porch&id=20170518102400")
+
+	signedTo := func(method, path string, k Key, at time.Time) *http.Request {
+		r, err := http.NewRequest(method, "http://app.example.com"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Sign(r, body, k, at); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	signed := func(k Key, at time.Time) *http.Request {
+		return signedTo("POST", "/api/newfile", k, at)
+	}
+	unsigned, _ := http.NewRequest("POST", "/api/newfile", nil)
+	elsewhere := func(r *http.Request, method, path string) *http.Request {
+		r.Method, r.URL.Path = method, path
+		return r
+	}
+
+	for _, k := range []Key{old, cur} {
+		if err := v.Verify(signed(k, now), body, now); err != nil {
+			t.Errorf("key %v: %v", k.ID, err)
+		}
+	}
+
+	r := signed(cur, now)
+	if err := v.Verify(r, body, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Verify(r, body, now); err != ErrReplay {
+		t.Errorf("replay = %v, want ErrReplay", err)
+	}
+
+	tests := []struct {
+		name string
+		r    *http.Request
+		body string
+		exp  error
+	}{
+		{"unsigned", unsigned, string(body), ErrUnsigned},
+		{"other endpoint", elsewhere(signed(cur, now), "POST", "/api/heartbeat"), string(body), ErrBadSignature},
+		{"other method", elsewhere(signed(cur, now), "PUT", "/api/newfile"), string(body), ErrBadSignature},
+		{"unknown key", signed(Key{"other", []byte("x")}, now), string(body), ErrUnknownKey},
+		{"wrong secret", signed(Key{"new", []byte("x")}, now), string(body), ErrBadSignature},
+		{"altered body", signed(cur, now), "cam=porch&id=1", ErrBadSignature},
+		{"too old", signed(cur, now.Add(-6*time.Minute)), string(body), ErrSkew},
+		{"too new", signed(cur, now.Add(6*time.Minute)), string(body), ErrSkew},
+	}
+	for _, test := range tests {
+		if err := v.Verify(test.r, []byte(test.body), now); err != test.exp {
+			t.Errorf("%v: got %v, want %v", test.name, err, test.exp)
+		}
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	ks, err := ParseKeys("a:x, b:y:z,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ks) != 2 || ks[0].ID != "a" || string(ks[1].Secret) != "y:z" {
+		t.Errorf("ParseKeys = %+v", ks)
+	}
+	if _, err := ParseKeys("nocolon"); err == nil {
+		t.Errorf("ParseKeys(nocolon) succeeded")
+	}
+}
@@ -2,15 +2,20 @@ package main
 
 import (
 	"context"
+	"crypto/md5"
 	"flag"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"log"
+	"log/slog"
 	"net/url"
 	"os"
 	"time"
 
 	"github.com/dustin/go-humanize"
+	"github.com/dustin/reye/crypt"
+	"github.com/dustin/reye/logging"
 	"github.com/dustin/reye/vidtool"
 
 	"cloud.google.com/go/storage"
@@ -21,10 +26,14 @@ import (
 
 var (
 	authFile          = flag.String("authfile", "", "Path to auth json file")
+	useSyslog         = flag.Bool("syslog", false, "Log to syslog")
 	bucketName        = flag.String("bucket", "", "Bucket name")
 	minRatio          = flag.Int("minRatio", 40, "Minimum percentage considered valid")
 	onlyBroken        = flag.Bool("onlybroken", false, "Only update obviously broken outputs")
 	filterConcurrency = flag.Int("filter_concurrency", 8, "How many filters to run concurrently")
+	masterFile        = flag.String("master_key", "", "Master key file for encrypted clips")
+
+	masterKey *crypt.MasterKey
 
 	basePath string
 )
@@ -83,6 +92,18 @@ func findAll(ctx context.Context, bucket *storage.BucketHandle) ([]*clip, error)
 	return rv, nil
 }
 
+// decrypted returns a reader of the plaintext of r, which has the
+// given metadata.
+func decrypted(r io.Reader, md map[string]string) (io.Reader, error) {
+	if !crypt.Encrypted(md) {
+		return r, nil
+	}
+	if masterKey == nil {
+		return nil, fmt.Errorf("clip is encrypted, but no -master_key given")
+	}
+	return masterKey.Decrypt(r, md)
+}
+
 func initStorageClient(ctx context.Context) *storage.Client {
 	client, err := storage.NewClient(ctx, option.WithServiceAccountFile(*authFile))
 	if err != nil {
@@ -130,7 +151,7 @@ func getOrigDuration(ctx context.Context, bucket *storage.BucketHandle, c *clip)
 	}
 	newattrs.Metadata["duration"] = dur.String()
 	if _, err = obj.Update(ctx, newattrs); err != nil {
-		log.Printf("Error updating mp4 duration: %v", err)
+		logging.From(ctx).Warn("error updating mp4 duration", "error", err)
 	}
 	return dur, nil
 }
@@ -138,7 +159,9 @@ func getOrigDuration(ctx context.Context, bucket *storage.BucketHandle, c *clip)
 func transcode(ctx context.Context, bucket *storage.BucketHandle, c *clip) error {
 	grp := errgroup.Group{}
 
-	log.Printf("Transcoding %v", c)
+	l := slog.Default().With(logging.Clip, c.name)
+	ctx = logging.With(ctx, l)
+	l.Info("transcoding", logging.Phase, "download", logging.Bytes, c.avi.Size, "ratio", c.ratio())
 	start := time.Now()
 	obj := bucket.Object(c.avi.Name)
 	r, err := obj.NewReader(ctx)
@@ -147,6 +170,11 @@ func transcode(ctx context.Context, bucket *storage.BucketHandle, c *clip) error
 	}
 	defer r.Close()
 
+	src, err := decrypted(r, c.avi.Metadata)
+	if err != nil {
+		return err
+	}
+
 	iname := url.QueryEscape(c.avi.Name)
 	oname := url.QueryEscape(c.mp4.Name)
 
@@ -156,7 +184,7 @@ func transcode(ctx context.Context, bucket *storage.BucketHandle, c *clip) error
 	}
 	defer tmpf.Close()
 	defer os.Remove(iname)
-	if _, err := io.Copy(tmpf, r); err != nil {
+	if _, err := io.Copy(tmpf, src); err != nil {
 		return err
 	}
 
@@ -179,13 +207,13 @@ func transcode(ctx context.Context, bucket *storage.BucketHandle, c *clip) error
 	if !*onlyBroken {
 		odur, err := getOrigDuration(ctx, bucket, c)
 		if err != nil {
-			log.Printf("Error getting original clip duration: %v", err)
+			l.Warn("error getting original clip duration", "error", err)
 			odur = 0
 		}
 
 		if abs(odur-idur) < time.Second {
-			log.Printf("Skipping %v, since it's roughly the same size (%v vs. %v)",
-				c, idur, odur)
+			l.Info("skipping, since it's roughly the same length", logging.Phase, "transcode",
+				"duration", idur, "mp4_duration", odur)
 			return nil
 		}
 	}
@@ -195,26 +223,53 @@ func transcode(ctx context.Context, bucket *storage.BucketHandle, c *clip) error
 	if err != nil {
 		return err
 	}
+	l.Info("transcoded", logging.Phase, "transcode", "duration", odur)
 
 	grp.Go(func() error {
+		md5sum, crc, err := fileSums(oname)
+		if err != nil {
+			return err
+		}
+
 		dest := bucket.Object(c.mp4.Name)
 		w := dest.NewWriter(ctx)
-		w.ObjectAttrs.Metadata = c.mp4.Metadata
+		w.ObjectAttrs.Metadata = map[string]string{}
+		for k, v := range c.mp4.Metadata {
+			// The old checksums are of the old mp4.
+			if !crypt.IsMetadata(k) && k != "md5" && k != "crc32c" {
+				w.ObjectAttrs.Metadata[k] = v
+			}
+		}
 		w.ObjectAttrs.ContentType = c.mp4.ContentType
 		w.ObjectAttrs.Metadata["duration"] = odur.String()
+		w.ObjectAttrs.Metadata["md5"] = md5sum
+		w.ObjectAttrs.Metadata["crc32c"] = crc
 
 		f, err := os.Open(oname)
 		if err != nil {
 			return err
 		}
 		defer f.Close()
-		n, err := io.Copy(w, f)
+
+		// Keep the mp4 encrypted if the original was.
+		var src io.Reader = f
+		if crypt.Encrypted(c.avi.Metadata) {
+			er, md, err := masterKey.Encrypt(f)
+			if err != nil {
+				return err
+			}
+			for k, v := range md {
+				w.ObjectAttrs.Metadata[k] = v
+			}
+			src = er
+		}
+		n, err := io.Copy(w, src)
 		if err != nil {
 			return err
 		}
 
-		log.Printf("Downloaded, transcoded, and uploaded %v bytes in %v",
-			humanize.Bytes(uint64(n)), time.Since(start))
+		l.Info("uploaded", logging.Phase, "upload", logging.Object, c.mp4.Name, logging.Bytes, n,
+			"took", time.Since(start))
 
 		return w.Close()
 	})
@@ -222,6 +277,21 @@ func transcode(ctx context.Context, bucket *storage.BucketHandle, c *clip) error
 	return grp.Wait()
 }
 
+// fileSums hashes the named file the way the uploader does for an
+// object's md5 and crc32c metadata: before any encryption.
+func fileSums(fn string) (string, string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	m, crc := md5.New(), crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	if _, err := io.Copy(io.MultiWriter(m, crc), f); err != nil {
+		return "", "", err
+	}
+	return fmt.Sprintf("%x", m.Sum(nil)), fmt.Sprintf("%08x", crc.Sum32()), nil
+}
+
 func filter(ctx context.Context, bucket *storage.BucketHandle, clips []*clip) chan *clip {
 	grp := errgroup.Group{}
 
@@ -251,9 +321,17 @@ func filter(ctx context.Context, bucket *storage.BucketHandle, clips []*clip) ch
 
 func main() {
 	flag.Parse()
+	logging.MustSetup("transcoder", *useSyslog)
 
 	ctx := context.Background()
 
+	if *masterFile != "" {
+		var err error
+		if masterKey, err = crypt.LoadMasterKey(*masterFile); err != nil {
+			log.Fatalf("Can't load master key: %v", err)
+		}
+	}
+
 	sto := initStorageClient(ctx)
 	bucket := sto.Bucket(*bucketName)
 
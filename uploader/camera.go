@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dustin/reye/logging"
+	"github.com/dustin/reye/vidtool"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	configFile  = flag.String("config", "", "YAML file describing the cameras to upload from")
+	transcoders = flag.Int("transcoders", 2, "maximum number of concurrent transcodes across all cameras")
+)
+
+// A camera is a single motion output directory we upload from.
+// Anything left out of the config falls back to the equivalent flag.
+// The app can override some of it; see remoteConfig.
+type camera struct {
+	ID              string        `yaml:"id"`
+	Dir             string        `yaml:"dir"`
+	Bucket          string        `yaml:"bucket"`
+	Prefix          string        `yaml:"prefix"`
+	DeleteDays      int           `yaml:"delete_days"`
+	TriggerURL      string        `yaml:"trigger_url"`
+	SnapshotTimeout time.Duration `yaml:"snapshot_timeout"`
+	SnapshotEvery   time.Duration `yaml:"snapshot_every"`
+	SnapshotDays    int           `yaml:"snapshot_days"`
+	PausePolicy     string        `yaml:"pause_policy"`
+	Notify          []*sinkConfig `yaml:"notify"`
+	Filters         []*filterRule `yaml:"filters"`
+
+	// How motion names this camera's files; see namePattern.
+	MovieFilename    string `yaml:"movie_filename"`
+	PictureFilename  string `yaml:"picture_filename"`
+	SnapshotFilename string `yaml:"snapshot_filename"`
+	DetailsFilename  string `yaml:"details_filename"`
+	Timezone         string `yaml:"timezone"`
+
+	sto        blobStore
+	jrnl       *journal
+	sinks      []*sinkQueue
+	names      *naming
+	announcing announcements
+	health     camHealth
+	history    snapHistory
+	tally      passTally
+	pause      pauseState
+	remote     remoteState
+}
+
+// config is the layout of the -config file, e.g.:
+//
+//	cameras:
+//	  - id: basement
+//	    dir: /var/lib/motion/basement
+//	    delete_days: 3
+//	  - id: porch
+//	    dir: /var/lib/motion/porch
+//	    bucket: porch-media
+//	    snapshot_timeout: 10s
+//	    snapshot_every: 10m
+//	    snapshot_days: 3
+//	    pause_policy: discard
+//	    movie_filename: porch-%Y%m%d-%H%M%S-%v
+//	    timezone: UTC
+//
+// See sinkConfig for the notify section and filterRule for filters.
+type config struct {
+	Cameras []*camera     `yaml:"cameras"`
+	Notify  []*sinkConfig `yaml:"notify"`
+	Filters []*filterRule `yaml:"filters"`
+}
+
+func (cam *camera) applyDefaults() {
+	if cam.Bucket == "" {
+		cam.Bucket = *bucketName
+	}
+	if cam.Prefix == "" {
+		cam.Prefix = cam.ID
+	}
+	if cam.DeleteDays == 0 {
+		cam.DeleteDays = *deleteDays
+	}
+	if cam.TriggerURL == "" {
+		cam.TriggerURL = *triggerURL
+	}
+	if cam.SnapshotTimeout == 0 {
+		cam.SnapshotTimeout = *snapTimeout
+	}
+	if cam.SnapshotEvery == 0 {
+		cam.SnapshotEvery = *snapEvery
+	}
+	if cam.SnapshotDays == 0 {
+		cam.SnapshotDays = *snapDays
+	}
+	if cam.PausePolicy == "" {
+		cam.PausePolicy = *pausePolicy
+	}
+	for _, p := range []struct {
+		dest *string
+		def  string
+	}{
+		{&cam.MovieFilename, *movieFilename},
+		{&cam.PictureFilename, *pictureFilename},
+		{&cam.SnapshotFilename, *snapshotFilename},
+		{&cam.DetailsFilename, *detailsFilename},
+		{&cam.Timezone, *timezone},
+	} {
+		if *p.dest == "" {
+			*p.dest = p.def
+		}
+	}
+}
+
+func loadConfig(fn string) ([]*camera, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var conf config
+	if err := yaml.UnmarshalStrict(b, &conf); err != nil {
+		return nil, err
+	}
+	if len(conf.Cameras) == 0 {
+		return nil, fmt.Errorf("no cameras defined in %v", fn)
+	}
+	for _, r := range conf.Filters {
+		if err := r.compile(); err != nil {
+			return nil, err
+		}
+	}
+	seen := map[string]bool{}
+	prefixes := map[string]string{}
+	dirs := map[string]string{}
+	for i, cam := range conf.Cameras {
+		if cam.ID == "" || cam.Dir == "" {
+			return nil, fmt.Errorf("camera %d in %v needs both an id and a dir", i, fn)
+		}
+		if seen[cam.ID] {
+			return nil, fmt.Errorf("camera %v defined more than once in %v", cam.ID, fn)
+		}
+		seen[cam.ID] = true
+		// Two cameras in one dir would fight over its clips and journal.
+		dir := filepath.Clean(cam.Dir)
+		if other, ok := dirs[dir]; ok {
+			return nil, fmt.Errorf("%v: dir %v is already used by %v", cam.ID, dir, other)
+		}
+		dirs[dir] = cam.ID
+		cam.Notify = append(conf.Notify[:len(conf.Notify):len(conf.Notify)], cam.Notify...)
+		for _, r := range cam.Filters {
+			if err := r.compile(); err != nil {
+				return nil, fmt.Errorf("%v: %v", cam.ID, err)
+			}
+		}
+		cam.Filters = append(cam.Filters[:len(cam.Filters):len(cam.Filters)], conf.Filters...)
+		cam.applyDefaults()
+		if strings.Contains(cam.Prefix, "/") {
+			// The app finds cameras by the first part of object names.
+			return nil, fmt.Errorf("%v: prefix %q can't contain a /", cam.ID, cam.Prefix)
+		}
+		if other, ok := prefixes[cam.Prefix]; ok {
+			return nil, fmt.Errorf("%v: prefix %v is already used by %v", cam.ID, cam.Prefix, other)
+		}
+		prefixes[cam.Prefix] = cam.ID
+		if err := checkPausePolicy(cam.PausePolicy); err != nil {
+			return nil, fmt.Errorf("%v: %v", cam.ID, err)
+		}
+		if err := cam.compileNaming(); err != nil {
+			return nil, err
+		}
+	}
+	return conf.Cameras, nil
+}
+
+// loadCameras returns the cameras from the config file, or the single
+// camera described by the command line.
+func loadCameras(dir string) ([]*camera, error) {
+	if *configFile != "" {
+		return loadConfig(*configFile)
+	}
+	cam := &camera{ID: *camid, Dir: dir}
+	cam.applyDefaults()
+	if err := checkPausePolicy(cam.PausePolicy); err != nil {
+		return nil, fmt.Errorf("-pause_policy: %v", err)
+	}
+	if err := cam.compileNaming(); err != nil {
+		return nil, err
+	}
+	return []*camera{cam}, nil
+}
+
+func (cam *camera) fq(fn string) string {
+	return path.Join(cam.Dir, fn)
+}
+
+// appID is what the app knows the camera as: the first part of its
+// objects' names.
+func (cam *camera) appID() string {
+	if cam.Prefix == "" {
+		return cam.ID
+	}
+	return cam.Prefix
+}
+
+// objectName is the name of the given clip object for this camera.
+func (cam *camera) objectName(fn string) string {
+	return path.Join(cam.Prefix, fn)
+}
+
+func (cam *camera) journalFile() string {
+	fn := *journalPath
+	if fn == "" {
+		fn = filepath.Join(cam.Dir, ".uploader.journal")
+	} else if *configFile != "" {
+		fn = fn + "." + cam.ID
+	}
+	return fn
+}
+
+// journalAge is how long the journal remembers clips: a day longer
+// than retention keeps them.
+func (cam *camera) journalAge() time.Duration {
+	return time.Duration(cam.settings().DeleteDays+1) * 24 * time.Hour
+}
+
+func (cam *camera) initJournal() {
+	fn := cam.journalFile()
+	var err error
+	cam.jrnl, err = openJournal(fn, cam.journalAge())
+	if err != nil {
+		log.Fatalf("Can't open journal %v: %v", fn, err)
+	}
+	log.Printf("%v: journal %v has %v clips in progress", cam.ID, fn, len(cam.jrnl.clips))
+}
+
+// transcodeSlots limits transcoding across all cameras.
+var transcodeSlots chan bool
+
+func transcode(ctx context.Context, iname, oname string) (time.Duration, error) {
+	select {
+	case transcodeSlots <- true:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	defer func() { <-transcodeSlots }()
+
+	start := time.Now()
+	odur, err := vidtool.Transcode(ctx, iname, oname)
+	if err != nil {
+		return 0, err
+	}
+	transcodeDuration.Observe(time.Since(start).Seconds())
+	if st, err := os.Stat(oname); err == nil {
+		logging.From(ctx).Info("transcoded", logging.Phase, "transcode", logging.Bytes, st.Size(),
+			"duration", odur, "took", time.Since(start))
+	}
+	return odur, nil
+}
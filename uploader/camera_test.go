@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`
+notify:
+  - type: webhook
+    url: http://localhost/hook
+cameras:
+  - id: basement
+    dir: /var/lib/motion/basement
+    delete_days: 3
+  - id: porch
+    dir: /var/lib/motion/porch
+    bucket: porch-media
+    prefix: front
+    snapshot_timeout: 10s
+    notify:
+      - type: mqtt
+        broker: localhost:1883
+`)
+	f.Close()
+
+	cams, err := loadConfig(f.Name())
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if len(cams) != 2 {
+		t.Fatalf("got %v cameras, want 2", len(cams))
+	}
+
+	b, p := cams[0], cams[1]
+	if b.Bucket != *bucketName || b.Prefix != "basement" || b.DeleteDays != 3 || b.SnapshotTimeout != *snapTimeout {
+		t.Errorf("basement = %+v", b)
+	}
+	if p.Bucket != "porch-media" || p.Prefix != "front" || p.DeleteDays != *deleteDays || p.SnapshotTimeout != 10*time.Second {
+		t.Errorf("porch = %+v", p)
+	}
+	if len(b.Notify) != 1 || len(p.Notify) != 2 || b.Notify[0] != p.Notify[0] || p.Notify[1].Type != "mqtt" {
+		t.Errorf("notify: basement=%v, porch=%v", b.Notify, p.Notify)
+	}
+	if got := p.objectName("x.jpg"); got != "front/x.jpg" {
+		t.Errorf("objectName = %v, want front/x.jpg", got)
+	}
+	if got := p.appID(); got != "front" {
+		t.Errorf("appID = %v, want front", got)
+	}
+	if got := p.announcement(clip{}, statusPending, 0, false).Prefix; got != "front" {
+		t.Errorf("announced with prefix %q, want front", got)
+	}
+}
+
+func TestLoadConfigConflicts(t *testing.T) {
+	for _, conf := range []string{
+		"cameras:\n  - {id: porch, dir: /m/porch, prefix: front/door}\n",
+		"cameras:\n  - {id: porch, dir: /m/porch}\n  - {id: yard, dir: /m/yard, prefix: porch}\n",
+		"cameras:\n  - {id: porch, dir: /m/porch}\n  - {id: yard, dir: /m/porch}\n",
+		"cameras:\n  - {id: porch, dir: /m/porch}\n  - {id: yard, dir: /m/./porch/}\n",
+	} {
+		f, err := ioutil.TempFile("", "config")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		f.WriteString(conf)
+		f.Close()
+		if _, err := loadConfig(f.Name()); err == nil {
+			t.Errorf("loadConfig accepted %q", conf)
+		}
+	}
+}
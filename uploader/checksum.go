@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksums are the hashes we compare between local and stored content.
+type checksums struct {
+	MD5    []byte
+	CRC32C uint32
+}
+
+func (c checksums) String() string {
+	return fmt.Sprintf("md5=%x crc32c=%08x", c.MD5, c.CRC32C)
+}
+
+// hasher computes checksums of everything written to it.
+type hasher struct {
+	md5 hash.Hash
+	crc hash.Hash32
+}
+
+func newHasher() *hasher {
+	return &hasher{md5.New(), crc32.New(crc32cTable)}
+}
+
+func (h *hasher) Write(p []byte) (int, error) {
+	h.md5.Write(p)
+	return h.crc.Write(p)
+}
+
+func (h *hasher) sums() checksums {
+	return checksums{h.md5.Sum(nil), h.crc.Sum32()}
+}
+
+// hashFile computes the checksums of f and rewinds it.
+func hashFile(f *os.File) (checksums, error) {
+	h := newHasher()
+	if _, err := io.Copy(h, f); err != nil {
+		return checksums{}, err
+	}
+	_, err := f.Seek(0, io.SeekStart)
+	return h.sums(), err
+}
+
+// objectInfo is what a store tells us about something it's holding.
+// Stores that can't provide a particular hash leave it empty.
+type objectInfo struct {
+	Size      int64
+	MD5       []byte
+	CRC32C    uint32
+	HasCRC32C bool
+}
+
+// verifyObject makes sure the named object is what we think we sent.
+func verifyObject(ctx context.Context, sto blobStore, name string, size int64, want checksums) error {
+	info, err := sto.Stat(ctx, name)
+	if err != nil {
+		return fmt.Errorf("verifying %v: %v", name, err)
+	}
+	if info.Size != size {
+		return fmt.Errorf("%v is %v bytes in the store, want %v", name, info.Size, size)
+	}
+	if len(info.MD5) > 0 && !bytes.Equal(info.MD5, want.MD5) {
+		return fmt.Errorf("%v has md5 %x in the store, want %x", name, info.MD5, want.MD5)
+	}
+	if info.HasCRC32C && info.CRC32C != want.CRC32C {
+		return fmt.Errorf("%v has crc32c %08x in the store, want %08x", name, info.CRC32C, want.CRC32C)
+	}
+	return nil
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/dustin/httputil"
+)
+
+var daemonURL = flag.String("daemon", "", "base URL of the running uploader for status and retry (default from -http)")
+
+// commands are what the uploader can do besides running as a daemon.
+// Each may be followed by the clip directory when there's no -config.
+var commands = map[string]struct {
+	args  []string
+	usage string
+}{
+	"once":         {nil, "upload whatever's ready, print a summary and exit non-zero if anything failed"},
+	"list-pending": {nil, "list the clips, incomplete clips and snapshots waiting, and why"},
+	"retry":        {[]string{"clip"}, "upload a clip (by timestamp or file name) now, ignoring any backoff"},
+	"status":       {nil, "show the running uploader's state"},
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %v [flags] [command] [dir]\n\nCommands (the default is to run as a daemon):\n", os.Args[0])
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := commands[name]
+		var args string
+		for _, a := range c.args {
+			args += " <" + a + ">"
+		}
+		fmt.Fprintf(out, "  %v%v\n    \t%v\n", name, args, c.usage)
+	}
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// parseCommand splits the command line into a command (empty to run
+// as a daemon), its arguments, and the clip directory.
+func parseCommand(args []string) (string, []string, string, error) {
+	if len(args) == 0 {
+		return "", nil, "", nil
+	}
+	c, ok := commands[args[0]]
+	if !ok {
+		if len(args) > 1 {
+			return "", nil, "", fmt.Errorf("unknown command %q", args[0])
+		}
+		return "", nil, args[0], nil
+	}
+	cmd, args := args[0], args[1:]
+	if len(args) < len(c.args) || len(args) > len(c.args)+1 {
+		return "", nil, "", fmt.Errorf("usage: %v <%v> [dir]", cmd, strings.Join(c.args, "> <"))
+	}
+	var dir string
+	if len(args) > len(c.args) {
+		dir = args[len(c.args)]
+	}
+	return cmd, args[:len(c.args)], dir, nil
+}
+
+// passTally counts what happened to a camera's clips, for once's
+// summary.
+type passTally struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (cam *camera) count(outcome string) {
+	cam.tally.mu.Lock()
+	defer cam.tally.mu.Unlock()
+	if cam.tally.counts == nil {
+		cam.tally.counts = map[string]int{}
+	}
+	cam.tally.counts[outcome]++
+}
+
+func (cam *camera) summary() string {
+	cam.tally.mu.Lock()
+	defer cam.tally.mu.Unlock()
+	var rv []string
+	for _, k := range []string{"uploaded", "failed", "filtered", "held", "backing off", "paused", "discarded", "snapshots"} {
+		rv = append(rv, fmt.Sprintf("%v %v", cam.tally.counts[k], k))
+	}
+	return strings.Join(rv, ", ")
+}
+
+// runOnce does a single pass of everything for every camera.
+func runOnce(ctx context.Context, cams []*camera) int {
+	rv := 0
+	for _, cam := range cams {
+		var errs []string
+		for _, p := range []struct {
+			name string
+			f    func(context.Context) error
+		}{
+			{"delete old files", cam.removeOldFiles},
+			{"upload snaps", cam.uploadSnapshots},
+			{"upload clips", cam.uploadClips},
+		} {
+			if err := p.f(ctx); err != nil {
+				errs = append(errs, fmt.Sprintf("%v: %v", p.name, err))
+			}
+		}
+		fmt.Printf("%v: %v\n", cam.ID, cam.summary())
+		for _, e := range errs {
+			fmt.Printf("%v: %v\n", cam.ID, e)
+			rv = 1
+		}
+	}
+	return rv
+}
+
+// pendingItem is something in a camera's directory, and what the
+// uploader is going to do about it.
+type pendingItem struct {
+	kind, name, reason string
+}
+
+// pending describes everything in the camera's directory the uploader
+// has yet to finish with.
+func (cam *camera) pending(now time.Time) ([]pendingItem, error) {
+	d, err := os.Open(cam.Dir)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	dents, err := d.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	var rv []pendingItem
+	clips := map[int]clip{}
+	for _, dent := range dents {
+		dname := dent.Name()
+		switch {
+		case dname == "lastsnap.jpg":
+			sn, _ := os.Readlink(cam.fq(dname))
+			next := "uploaded on the next pass"
+			if cam.paused(now) {
+				next = "not uploaded while paused"
+			}
+			rv = append(rv, pendingItem{"snapshot", dname, fmt.Sprintf("latest (%v), %v", sn, next)})
+		case cam.isSnapshot(dname):
+			rv = append(rv, pendingItem{"snapshot", dname, "superseded, deleted on the next pass"})
+		default:
+			cam.addClipFile(clips, dent)
+		}
+	}
+
+	for id, c := range clips {
+		if !c.complete() {
+			rv = append(rv, pendingItem{"incomplete", fmt.Sprint("event ", id), c.waiting(now)})
+			continue
+		}
+		rv = append(rv, pendingItem{"clip", c.key(), cam.clipStatus(c, now)})
+	}
+
+	if _, times, err := cam.historyFiles(); err == nil && len(times) > 0 {
+		rv = append(rv, pendingItem{"history", ".snapshots", fmt.Sprintf("%v kept, %v to %v",
+			len(times), times[0].Format(time.RFC3339), times[len(times)-1].Format(time.RFC3339))})
+	}
+
+	sort.Slice(rv, func(i, j int) bool {
+		if rv[i].kind != rv[j].kind {
+			return rv[i].kind < rv[j].kind
+		}
+		return rv[i].name < rv[j].name
+	})
+	return rv, nil
+}
+
+// waiting describes what an incomplete clip is waiting for.
+func (c clip) waiting(now time.Time) string {
+	missing := "missing " + strings.Join(c.missing(), ", ")
+	switch {
+	case *orphanGrace <= 0:
+		return missing + "; waiting for the rest"
+	case c.orphaned():
+		return missing + "; salvaged or quarantined on the next pass"
+	}
+	left := c.lastModified().Add(*orphanGrace).Sub(now).Round(time.Second)
+	return fmt.Sprintf("%v; salvaged or quarantined in %v", missing, left)
+}
+
+// clipStatus describes where a complete clip is in its upload.
+func (cam *camera) clipStatus(c clip, now time.Time) string {
+	st := cam.jrnl.state(c.key())
+	var done []string
+	for _, ext := range []string{"jpg", "mp4", "avi"} {
+		if st.Uploaded[ext] {
+			done = append(done, ext)
+		}
+	}
+	switch {
+	case st.Filtered == "paused":
+		return "discarded while paused, waiting for cleanup"
+	case st.Filtered != "":
+		return fmt.Sprintf("dropped by filter %q, waiting for cleanup", st.Filtered)
+	case cam.finished(c.key()) && !st.Notified:
+		return "uploaded, announcing it"
+	case cam.finished(c.key()):
+		return "uploaded, waiting for cleanup"
+	case now.Before(st.NextTry):
+		return fmt.Sprintf("backing off until %v after %v failures: %v",
+			st.NextTry.Format(time.RFC3339), st.Attempts, st.LastError)
+	case cam.PausePolicy == pauseDiscard && len(done) == 0 && cam.paused(c.ts):
+		return "captured while paused, discarded on the next pass"
+	case cam.paused(now):
+		return "paused, held until the camera's resumed"
+	case !st.Uploaded["avi"] && st.Uploaded["jpg"] && st.Uploaded["mp4"] && holdAVI(now):
+		return "holding the original until the AVI upload window"
+	case len(done) > 0:
+		return fmt.Sprintf("partly uploaded (%v), resuming on the next pass", strings.Join(done, ", "))
+	}
+	return fmt.Sprintf("ready to upload (%v)", humanize.Bytes(uint64(c.ovid.Size()+c.thumb.Size())))
+}
+
+func listPending(w io.Writer, cams []*camera) int {
+	rv := 0
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	now := time.Now()
+	for _, cam := range cams {
+		items, err := cam.pending(now)
+		if err != nil {
+			fmt.Fprintf(tw, "%v\terror\t\t%v\n", cam.ID, err)
+			rv = 1
+			continue
+		}
+		if len(items) == 0 {
+			fmt.Fprintf(tw, "%v\t\t\tnothing pending\n", cam.ID)
+		}
+		for _, it := range items {
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", cam.ID, it.kind, it.name, it.reason)
+		}
+	}
+	tw.Flush()
+	return rv
+}
+
+// findRetry finds the clip named by name: its timestamp key or any of
+// its files.
+func (cam *camera) findRetry(name string) (clip, bool, error) {
+	if id, ok := cam.clipID(name); ok {
+		c, err := cam.findClip(id)
+		return c, c.ovid != nil || c.thumb != nil || c.df != nil, err
+	}
+	d, err := os.Open(cam.Dir)
+	if err != nil {
+		return clip{}, false, err
+	}
+	defer d.Close()
+	dents, err := d.Readdir(-1)
+	if err != nil {
+		return clip{}, false, err
+	}
+	clips := map[int]clip{}
+	for _, dent := range dents {
+		cam.addClipFile(clips, dent)
+	}
+	for _, c := range clips {
+		if c.ovid != nil && c.key() == name {
+			return c, true, nil
+		}
+	}
+	return clip{}, false, nil
+}
+
+// retry forgets any backoff for the named clip and queues it.
+func retry(ctx context.Context, cams []*camera, camID, name string) (<-chan error, error) {
+	for _, cam := range cams {
+		if camID != "" && cam.ID != camID {
+			continue
+		}
+		c, ok, err := cam.findRetry(name)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", cam.ID, err)
+		}
+		if !ok {
+			continue
+		}
+		if !c.complete() {
+			return nil, fmt.Errorf("%v: %v is %v", cam.ID, name, c.waiting(time.Now()))
+		}
+		cam.jrnl.record(c.key(), func(s *clipState) { s.NextTry = time.Time{} })
+		return clipWork.submit(ctx, cam, c), nil
+	}
+	return nil, fmt.Errorf("no clip %q found", name)
+}
+
+// retryHandler lets the retry command have the daemon do it.
+func retryHandler(ctx context.Context, cams []*camera) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ch, err := retry(ctx, cams, r.FormValue("camera"), r.FormValue("clip"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err := <-ch; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "uploaded %v\n", r.FormValue("clip"))
+	})
+}
+
+// daemon returns the running uploader's URL for the given path, or ""
+// if we don't know where it is.
+func daemon(p string) string {
+	u := *daemonURL
+	if u == "" && *httpAddr != "" {
+		host := *httpAddr
+		if strings.HasPrefix(host, ":") {
+			host = "localhost" + host
+		}
+		u = "http://" + host
+	}
+	if u == "" {
+		return ""
+	}
+	return strings.TrimSuffix(u, "/") + p
+}
+
+// runRetry has the daemon retry the clip if there's one running, and
+// otherwise does it here.
+func runRetry(ctx context.Context, cams []*camera, name string) int {
+	if u := daemon("/retry"); u != "" {
+		res, err := http.PostForm(u, url.Values{"clip": {name}})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error asking the uploader to retry %v: %v\n", name, err)
+			return 1
+		}
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			fmt.Fprintf(os.Stderr, "Error retrying %v: %v\n", name, httputil.HTTPError(res))
+			return 1
+		}
+		io.Copy(os.Stdout, res.Body)
+		return 0
+	}
+	ch, err := retry(ctx, cams, "", name)
+	if err == nil {
+		err = <-ch
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error retrying %v: %v\n", name, err)
+		return 1
+	}
+	fmt.Printf("uploaded %v\n", name)
+	return 0
+}
+
+// camStatus is a camera's part of the daemon's status.
+type camStatus struct {
+	heartbeat
+	Dir     string               `json:"dir"`
+	Journal int                  `json:"journal"`
+	Failing int                  `json:"failing"`
+	Passes  map[string]time.Time `json:"passes"`
+
+	// The pause policy being applied, if the camera's paused.
+	Paused string `json:"paused,omitempty"`
+
+	// The settings in effect, and how fetching them from the app went.
+	Config        remoteConfig `json:"config"`
+	ConfigFetched time.Time    `json:"config_fetched"`
+	ConfigError   string       `json:"config_error,omitempty"`
+}
+
+// daemonStatus is what the status command shows.
+type daemonStatus struct {
+	Version string      `json:"version"`
+	Started time.Time   `json:"started"`
+	Cameras []camStatus `json:"cameras"`
+}
+
+func (cam *camera) status(now time.Time) camStatus {
+	st := camStatus{heartbeat: cam.heartbeat(now), Dir: cam.Dir, Passes: map[string]time.Time{}}
+	if cam.jrnl != nil {
+		cam.jrnl.mu.Lock()
+		st.Journal = len(cam.jrnl.clips)
+		for _, cs := range cam.jrnl.clips {
+			if now.Before(cs.NextTry) {
+				st.Failing++
+			}
+		}
+		cam.jrnl.mu.Unlock()
+	}
+	if cam.paused(now) {
+		st.Paused = cam.PausePolicy
+	}
+	st.Config = cam.settings()
+	cam.remote.mu.Lock()
+	st.ConfigFetched, st.ConfigError = cam.remote.fetched, cam.remote.fetchErr
+	cam.remote.mu.Unlock()
+	passes.Lock()
+	for name, t := range passes.m {
+		if strings.HasPrefix(name, cam.ID+": ") {
+			st.Passes[strings.TrimPrefix(name, cam.ID+": ")] = t
+		}
+	}
+	passes.Unlock()
+	return st
+}
+
+func statusHandler(cams []*camera) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		st := daemonStatus{Version: version, Started: started}
+		for _, cam := range cams {
+			st.Cameras = append(st.Cameras, cam.status(now))
+		}
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(st)
+	})
+}
+
+func printStatus(w io.Writer, st daemonStatus, now time.Time) {
+	ago := func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return humanize.RelTime(t, now, "ago", "from now")
+	}
+	fmt.Fprintf(w, "uploader %v, started %v\n", st.Version, ago(st.Started))
+	for _, cam := range st.Cameras {
+		fmt.Fprintf(w, "\n%v (%v on %v)\n", cam.Camera, cam.Dir, cam.Host)
+		if cam.Paused != "" {
+			fmt.Fprintf(w, "  paused, will %v clips and snapshots\n", cam.Paused)
+		}
+		fmt.Fprintf(w, "  %v clips queued, %v unfinished, %v in the journal, %v backing off\n",
+			cam.Queued, cam.Pending, cam.Journal, cam.Failing)
+		if cam.TotalBytes > 0 {
+			fmt.Fprintf(w, "  %v free of %v\n", humanize.Bytes(cam.FreeBytes), humanize.Bytes(cam.TotalBytes))
+		}
+		fmt.Fprintf(w, "  last upload %v\n", ago(cam.LastUpload))
+		cf := cam.Config
+		fmt.Fprintf(w, "  config version %v (fetched %v): delete_days=%v trigger_url=%q snapshot_timeout=%v\n",
+			cf.Version, ago(cam.ConfigFetched), cf.DeleteDays, cf.TriggerURL, cf.SnapshotTimeout)
+		if cam.ConfigError != "" {
+			fmt.Fprintf(w, "  config error: %v\n", cam.ConfigError)
+		}
+		if cam.LastError != "" {
+			fmt.Fprintf(w, "  last error %v: %v\n", ago(cam.LastErrorAt), cam.LastError)
+		}
+		var names []string
+		for name := range cam.Passes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "  %v last succeeded %v\n", name, ago(cam.Passes[name]))
+		}
+	}
+}
+
+func getStatus(u string) (daemonStatus, error) {
+	var st daemonStatus
+	res, err := http.Get(u)
+	if err != nil {
+		return st, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return st, httputil.HTTPError(res)
+	}
+	err = json.NewDecoder(res.Body).Decode(&st)
+	return st, err
+}
+
+func runStatus() int {
+	u := daemon("/status")
+	if u == "" {
+		fmt.Fprintln(os.Stderr, "Don't know where the uploader is; use -daemon or -http")
+		return 1
+	}
+	st, err := getStatus(u)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting status: %v\n", err)
+		return 1
+	}
+	printStatus(os.Stdout, st, time.Now())
+	return 0
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		args      []string
+		cmd, dir  string
+		cargs     []string
+		shouldErr bool
+	}{
+		{nil, "", "", nil, false},
+		{[]string{"/var/lib/motion"}, "", "/var/lib/motion", nil, false},
+		{[]string{"once"}, "once", "", nil, false},
+		{[]string{"once", "/var/lib/motion"}, "once", "/var/lib/motion", nil, false},
+		{[]string{"retry", "20170518102400"}, "retry", "", []string{"20170518102400"}, false},
+		{[]string{"retry", "20170518102400", "/m"}, "retry", "/m", []string{"20170518102400"}, false},
+		{[]string{"retry"}, "", "", nil, true},
+		{[]string{"status", "a", "b"}, "", "", nil, true},
+		{[]string{"bogus", "/m"}, "", "", nil, true},
+	}
+	for _, test := range tests {
+		cmd, cargs, dir, err := parseCommand(test.args)
+		if (err != nil) != test.shouldErr || cmd != test.cmd || dir != test.dir ||
+			strings.Join(cargs, " ") != strings.Join(test.cargs, " ") {
+			t.Errorf("parseCommand(%q) = %q, %q, %q, %v", test.args, cmd, cargs, dir, err)
+		}
+	}
+}
+
+func TestListPending(t *testing.T) {
+	dir, err := ioutil.TempDir("", "motion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, fn := range []string{
+		"1-20170518102400.avi", "1-20170518102400-00.jpg", "1.details",
+		"2-20170518112400.avi", "2-20170518112400-00.jpg", "2.details",
+		"3-20170518122400.avi",
+		"4-20170518122500-snapshot.jpg", "4-20170518122510-snapshot.jpg",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, fn), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("4-20170518122510-snapshot.jpg", filepath.Join(dir, "lastsnap.jpg")); err != nil {
+		t.Fatal(err)
+	}
+
+	cam := &camera{ID: "test", Dir: dir}
+	cam.jrnl, err = openJournal(filepath.Join(dir, ".uploader.journal"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cam.jrnl.failed("20170518102400", errors.New("no network"))
+
+	items, err := cam.pending(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, it := range items {
+		got[it.kind+" "+it.name] = it.reason
+	}
+	for k, exp := range map[string]string{
+		"clip 20170518102400":                    "backing off",
+		"clip 20170518112400":                    "ready to upload",
+		"incomplete event 3":                     "missing thumbnail, details",
+		"snapshot lastsnap.jpg":                  "latest",
+		"snapshot 4-20170518122500-snapshot.jpg": "deleted on the next pass",
+	} {
+		if !strings.Contains(got[k], exp) {
+			t.Errorf("%v: %q, want %q", k, got[k], exp)
+		}
+	}
+	if len(got) != 6 {
+		t.Errorf("got %v", got)
+	}
+
+	buf := &bytes.Buffer{}
+	if rv := listPending(buf, []*camera{cam}); rv != 0 || !strings.Contains(buf.String(), "no network") {
+		t.Errorf("listPending = %v:\n%v", rv, buf)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	cam := &camera{ID: "test", Dir: os.TempDir()}
+	passSucceeded(cam.ID, "upload clips")
+	cam.noteError(errors.New("something broke"))
+
+	s := httptest.NewServer(statusHandler([]*camera{cam}))
+	defer s.Close()
+
+	old := *daemonURL
+	defer func() { *daemonURL = old }()
+	*daemonURL = s.URL + "/"
+	if got := daemon("/status"); got != s.URL+"/status" {
+		t.Errorf("daemon(/status) = %v", got)
+	}
+
+	st, err := getStatus(daemon("/status"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Cameras) != 1 || st.Cameras[0].Camera != "test" || st.Cameras[0].LastError != "something broke" {
+		t.Fatalf("status = %+v", st)
+	}
+
+	buf := &bytes.Buffer{}
+	printStatus(buf, st, time.Now())
+	for _, exp := range []string{"test (", "last error", "something broke", "upload clips last succeeded"} {
+		if !strings.Contains(buf.String(), exp) {
+			t.Errorf("status output is missing %q:\n%v", exp, buf)
+		}
+	}
+}
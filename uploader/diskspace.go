@@ -0,0 +1,13 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// diskSpace returns the bytes available to us and the total size of
+// the filesystem holding dir.
+func diskSpace(dir string) (uint64, uint64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return 0, 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), uint64(st.Blocks) * uint64(st.Bsize), nil
+}
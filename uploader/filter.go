@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/reye/logging"
+	"github.com/dustin/reye/vidtool"
+)
+
+var filterDryRun = flag.Bool("filter_dry_run", false, "only report which clips the filters would drop")
+
+// A filterRule decides whether to keep or drop a clip before it's
+// uploaded.  Rules are configured like:
+//
+//	filters:
+//	  - name: night watch
+//	    action: keep
+//	    cameras: [porch]
+//	    hours: 20:00-06:00
+//	  - name: too short
+//	    action: drop
+//	    when:
+//	      duration: < 2s
+//	  - name: barely moved
+//	    action: drop
+//	    when:
+//	      changed_pixels: < 500
+//
+// A rule matches when the clip is from one of its cameras, was captured
+// within its hours, and meets every one of its conditions (any that are
+// left out always match).  Conditions compare a key from the clip's
+// details, or its probed duration, with one of < <= > >= == !=.  The
+// first matching rule (a camera's own before the top level ones)
+// decides; clips no rule matches are kept.
+type filterRule struct {
+	Name    string            `yaml:"name"`
+	Action  string            `yaml:"action"`
+	Cameras []string          `yaml:"cameras"`
+	Hours   string            `yaml:"hours"`
+	When    map[string]string `yaml:"when"`
+
+	hours *window
+	conds []condition
+}
+
+type condition struct {
+	key, op, val string
+}
+
+var filterOps = []string{"<=", ">=", "==", "!=", "<", ">"}
+
+func (r *filterRule) compile() error {
+	if r.Action != "keep" && r.Action != "drop" {
+		return fmt.Errorf("filter %q: action must be keep or drop", r.Name)
+	}
+	if r.Hours != "" {
+		w, err := parseWindow(r.Hours)
+		if err != nil {
+			return fmt.Errorf("filter %q: %v", r.Name, err)
+		}
+		r.hours = &w
+	}
+	r.conds = nil
+	for k, expr := range r.When {
+		expr = strings.TrimSpace(expr)
+		c := condition{key: k, op: "=="}
+		for _, op := range filterOps {
+			if strings.HasPrefix(expr, op) {
+				c.op = op
+				expr = strings.TrimSpace(strings.TrimPrefix(expr, op))
+				break
+			}
+		}
+		c.val = expr
+		if k == "duration" {
+			if _, err := time.ParseDuration(c.val); err != nil {
+				return fmt.Errorf("filter %q: %v", r.Name, err)
+			}
+		}
+		r.conds = append(r.conds, c)
+	}
+	return nil
+}
+
+func (r *filterRule) needsDuration() bool {
+	for _, c := range r.conds {
+		if c.key == "duration" {
+			return true
+		}
+	}
+	return false
+}
+
+func compare(op string, cmp int) bool {
+	switch op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "!=":
+		return cmp != 0
+	}
+	return cmp == 0
+}
+
+func (c condition) matches(details map[string]string, dur time.Duration) bool {
+	if c.key == "duration" {
+		want, _ := time.ParseDuration(c.val)
+		switch {
+		case dur < want:
+			return compare(c.op, -1)
+		case dur > want:
+			return compare(c.op, 1)
+		}
+		return compare(c.op, 0)
+	}
+	v, ok := details[c.key]
+	if !ok {
+		return false
+	}
+	a, aerr := strconv.ParseFloat(v, 64)
+	b, berr := strconv.ParseFloat(c.val, 64)
+	if aerr == nil && berr == nil {
+		switch {
+		case a < b:
+			return compare(c.op, -1)
+		case a > b:
+			return compare(c.op, 1)
+		}
+		return compare(c.op, 0)
+	}
+	return compare(c.op, strings.Compare(v, c.val))
+}
+
+func (r *filterRule) matches(camID string, c clip, dur time.Duration) bool {
+	if len(r.Cameras) > 0 {
+		found := false
+		for _, id := range r.Cameras {
+			found = found || id == camID
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.hours != nil && !r.hours.contains(c.ts) {
+		return false
+	}
+	for _, cond := range r.conds {
+		if !cond.matches(c.details, dur) {
+			return false
+		}
+	}
+	return true
+}
+
+// filterClip returns the rule that decides the clip's fate, if any.
+// The clip is only probed for its duration if a rule needs it.
+func (cam *camera) filterClip(ctx context.Context, c clip) (*filterRule, time.Duration, error) {
+	var dur time.Duration
+	probed := false
+	for _, r := range cam.Filters {
+		if r.needsDuration() && !probed {
+			d, err := vidtool.ClipDuration(ctx, cam.fq(c.ovid.Name()))
+			if err != nil {
+				return nil, 0, fmt.Errorf("probing duration: %v", err)
+			}
+			dur, probed = d, true
+		}
+		if r.matches(cam.ID, c, dur) {
+			return r, dur, nil
+		}
+	}
+	return nil, dur, nil
+}
+
+// recordFiltered notes a dropped clip (or one that would have been
+// dropped) in the camera's .filtered.log.
+func (cam *camera) recordFiltered(c clip, r *filterRule, dur time.Duration) error {
+	rec := struct {
+		Camera   string            `json:"camera"`
+		Clip     string            `json:"clip"`
+		Files    []string          `json:"files"`
+		Rule     string            `json:"rule"`
+		Details  map[string]string `json:"details,omitempty"`
+		Duration string            `json:"duration,omitempty"`
+		DryRun   bool              `json:"dry_run,omitempty"`
+		Filtered time.Time         `json:"filtered"`
+	}{Camera: cam.ID, Clip: c.key(), Rule: r.Name, Details: c.details, DryRun: *filterDryRun, Filtered: time.Now()}
+	for _, fi := range c.files() {
+		rec.Files = append(rec.Files, fi.Name())
+	}
+	if dur > 0 {
+		rec.Duration = dur.String()
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(cam.fq(".filtered.log"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// applyFilters decides whether a clip we haven't started on should be
+// uploaded, recording the decision if it's dropped.
+func (cam *camera) applyFilters(ctx context.Context, c clip) (bool, error) {
+	r, dur, err := cam.filterClip(ctx, c)
+	if err != nil || r == nil || r.Action == "keep" {
+		return err == nil, err
+	}
+	l := logging.From(ctx).With(logging.Phase, "filter", "rule", r.Name)
+	if err := cam.recordFiltered(c, r, dur); err != nil {
+		l.Error("error recording filtered clip", "error", err)
+	}
+	if *filterDryRun {
+		l.Info("would drop")
+		return true, nil
+	}
+	l.Info("dropping")
+	clipsFiltered.WithLabelValues(cam.ID, r.Name).Inc()
+	cam.jrnl.record(c.key(), func(s *clipState) { s.Filtered = r.Name })
+	return false, nil
+}
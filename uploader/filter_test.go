@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilterRules(t *testing.T) {
+	night := time.Date(2017, 5, 18, 23, 0, 0, 0, time.UTC)
+	day := time.Date(2017, 5, 18, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		rule    filterRule
+		cam     string
+		ts      time.Time
+		details map[string]string
+		dur     time.Duration
+		exp     bool
+	}{
+		{filterRule{When: map[string]string{"duration": "< 2s"}}, "porch", day, nil, time.Second, true},
+		{filterRule{When: map[string]string{"duration": "< 2s"}}, "porch", day, nil, 2 * time.Second, false},
+		{filterRule{When: map[string]string{"duration": ">=2s"}}, "porch", day, nil, 2 * time.Second, true},
+		{filterRule{When: map[string]string{"changed_pixels": "< 500"}}, "porch", day,
+			map[string]string{"changed_pixels": "120"}, 0, true},
+		{filterRule{When: map[string]string{"changed_pixels": "< 500"}}, "porch", day,
+			map[string]string{"changed_pixels": "1200"}, 0, false},
+		{filterRule{When: map[string]string{"changed_pixels": "< 500"}}, "porch", day, nil, 0, false},
+		{filterRule{When: map[string]string{"label": "cat"}}, "porch", day, map[string]string{"label": "cat"}, 0, true},
+		{filterRule{When: map[string]string{"label": "!= cat"}}, "porch", day, map[string]string{"label": "cat"}, 0, false},
+		{filterRule{Cameras: []string{"porch"}, Hours: "20:00-06:00"}, "porch", night, nil, 0, true},
+		{filterRule{Cameras: []string{"porch"}, Hours: "20:00-06:00"}, "porch", day, nil, 0, false},
+		{filterRule{Cameras: []string{"porch"}, Hours: "20:00-06:00"}, "basement", night, nil, 0, false},
+		{filterRule{When: map[string]string{"duration": "< 2s", "changed_pixels": "< 500"}}, "porch", day,
+			map[string]string{"changed_pixels": "100"}, 5 * time.Second, false},
+	}
+	for i, test := range tests {
+		r := test.rule
+		r.Action = "drop"
+		if err := r.compile(); err != nil {
+			t.Fatalf("compile #%d: %v", i, err)
+		}
+		c := clip{ts: test.ts, details: test.details}
+		if got := r.matches(test.cam, c, test.dur); got != test.exp {
+			t.Errorf("#%d: %+v matches(%v, %v, %v) = %v, want %v", i, test.rule, test.cam, test.details, test.dur, got, test.exp)
+		}
+	}
+
+	for _, bad := range []filterRule{
+		{Action: "maybe"},
+		{Action: "drop", Hours: "late"},
+		{Action: "drop", When: map[string]string{"duration": "< short"}},
+	} {
+		if err := bad.compile(); err == nil {
+			t.Errorf("compiled %+v", bad)
+		}
+	}
+}
+
+func TestApplyFilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "motion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rules := []*filterRule{
+		{Name: "night watch", Action: "keep", Hours: "20:00-06:00"},
+		{Name: "barely moved", Action: "drop", When: map[string]string{"changed_pixels": "< 500"}},
+	}
+	for _, r := range rules {
+		if err := r.compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cam := &camera{ID: "test", Dir: dir, Filters: rules}
+	cam.jrnl, err = openJournal(filepath.Join(dir, ".journal"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	small := map[string]string{"changed_pixels": "10"}
+	ctx := context.Background()
+	for _, test := range []struct {
+		ts     time.Time
+		dryRun bool
+		keep   bool
+	}{
+		{time.Date(2017, 5, 18, 23, 0, 0, 0, time.Local), false, true},
+		{time.Date(2017, 5, 18, 12, 0, 0, 0, time.Local), true, true},
+		{time.Date(2017, 5, 18, 12, 0, 1, 0, time.Local), false, false},
+	} {
+		*filterDryRun = test.dryRun
+		c := clip{ovid: fakeFile("1.avi"), ts: test.ts, details: small}
+		keep, err := cam.applyFilters(ctx, c)
+		if err != nil || keep != test.keep {
+			t.Errorf("applyFilters(%v, dry run=%v) = %v, %v; want %v", test.ts, test.dryRun, keep, err, test.keep)
+		}
+	}
+	*filterDryRun = false
+
+	if got := cam.jrnl.state("20170518120001").Filtered; got != "barely moved" {
+		t.Errorf("journal filtered = %q", got)
+	}
+	if got := cam.jrnl.state("20170518120000").Filtered; got != "" {
+		t.Errorf("dry run was journaled as filtered by %q", got)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, ".filtered.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"dry_run":true`) || !strings.Contains(lines[1], `"rule":"barely moved"`) {
+		t.Errorf("filter log:\n%s", b)
+	}
+}
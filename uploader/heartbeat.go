@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dustin/httputil"
+	"github.com/dustin/reye/sign"
+)
+
+var (
+	heartbeatURL   = flag.String("heartbeat_url", "", "URL of the app's /api/heartbeat to report our health to (signed with -triggerAuth)")
+	heartbeatEvery = flag.Duration("heartbeat_interval", 5*time.Minute, "how often to send a heartbeat")
+)
+
+// version identifies this build in heartbeats.  Set it with
+// -ldflags "-X main.version=..."
+var version = "dev"
+
+// camHealth is what a camera has been up to lately, for heartbeats.
+type camHealth struct {
+	mu          sync.Mutex
+	lastError   string
+	lastErrorAt time.Time
+	lastUpload  time.Time
+}
+
+func (cam *camera) noteError(err error) {
+	cam.health.mu.Lock()
+	defer cam.health.mu.Unlock()
+	cam.health.lastError = err.Error()
+	cam.health.lastErrorAt = time.Now()
+}
+
+func (cam *camera) noteUpload() {
+	cam.health.mu.Lock()
+	defer cam.health.mu.Unlock()
+	cam.health.lastUpload = time.Now()
+}
+
+// A heartbeat reports one camera's health to the app.
+type heartbeat struct {
+	Camera      string    `json:"camera"`
+	Version     string    `json:"version"`
+	Host        string    `json:"host"`
+	Sent        time.Time `json:"sent"`
+	FreeBytes   uint64    `json:"free_bytes"`
+	TotalBytes  uint64    `json:"total_bytes"`
+	Pending     int       `json:"pending"` // clips the journal hasn't seen through
+	Queued      int       `json:"queued"`  // clips waiting for an upload worker
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at"`
+	LastUpload  time.Time `json:"last_upload"`
+}
+
+func (cam *camera) heartbeat(now time.Time) heartbeat {
+	host, _ := os.Hostname()
+	hb := heartbeat{
+		Camera:  cam.ID,
+		Version: version,
+		Host:    host,
+		Sent:    now,
+		Pending: cam.jrnl.unfinished(),
+		Queued:  clipWork.pending(cam),
+	}
+	if free, total, err := diskSpace(cam.Dir); err != nil {
+		log.Printf("%v: checking free space for heartbeat: %v", cam.ID, err)
+	} else {
+		hb.FreeBytes, hb.TotalBytes = free, total
+	}
+
+	cam.health.mu.Lock()
+	defer cam.health.mu.Unlock()
+	hb.LastError = cam.health.lastError
+	hb.LastErrorAt = cam.health.lastErrorAt
+	hb.LastUpload = cam.health.lastUpload
+	return hb
+}
+
+// sendHeartbeat reports every camera's health in one signed request.
+func sendHeartbeat(ctx context.Context, u string, k sign.Key, cams []*camera) error {
+	now := time.Now()
+	var hbs []heartbeat
+	for _, cam := range cams {
+		hb := cam.heartbeat(now)
+		hb.Camera = cam.appID()
+		hbs = append(hbs, hb)
+	}
+	body, err := json.Marshal(hbs)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "application/json")
+	if err := sign.Sign(req, body, k, now); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, *notifyTimeout)
+	defer cancel()
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 204 {
+		return httputil.HTTPError(res)
+	}
+	return nil
+}
+
+// startHeartbeats sends a heartbeat now and every -heartbeat_interval
+// until we start shutting down.
+func startHeartbeats(ctx context.Context, cams []*camera) error {
+	if *heartbeatURL == "" {
+		return nil
+	}
+	k, err := sign.ParseKey(*triggerAuth)
+	if err != nil {
+		return fmt.Errorf("-triggerAuth: %v", err)
+	}
+	go func() {
+		t := time.NewTicker(*heartbeatEvery)
+		defer t.Stop()
+		for {
+			if err := sendHeartbeat(ctx, *heartbeatURL, k, cams); err != nil {
+				log.Printf("Error sending heartbeat: %v", err)
+			}
+			select {
+			case <-t.C:
+			case <-work.stopping:
+				return
+			}
+		}
+	}()
+	return nil
+}
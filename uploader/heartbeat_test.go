@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dustin/reye/sign"
+)
+
+func TestSendHeartbeat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "motion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := sign.Key{ID: "k1", Secret: []byte("sekrit")}
+	v := &sign.Verifier{Keys: []sign.Key{key}, MaxSkew: time.Minute}
+	var got []heartbeat
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := v.Verify(r, body, time.Now()); err != nil {
+			http.Error(w, err.Error(), 401)
+			return
+		}
+		if err := json.Unmarshal(body, &got); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		w.WriteHeader(204)
+	}))
+	defer s.Close()
+
+	porch := &camera{ID: "porch", Prefix: "front", Dir: dir}
+	basement := &camera{ID: "basement", Dir: dir}
+	porch.jrnl, err = openJournal(filepath.Join(dir, "porch.journal"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	porch.jrnl.record("done", func(st *clipState) {
+		st.Uploaded = map[string]bool{"mp4": true, "jpg": true, "avi": true}
+		st.Notified = true
+	})
+	porch.jrnl.record("unannounced", func(st *clipState) {
+		st.Uploaded = map[string]bool{"mp4": true, "jpg": true, "avi": true}
+	})
+	porch.jrnl.record("failing", func(st *clipState) { st.Attempts = 3 })
+	porch.jrnl.record("filtered", func(st *clipState) { st.Filtered = "too short" })
+	porch.noteUpload()
+	basement.noteError(errors.New("out of film"))
+
+	if err := sendHeartbeat(context.Background(), s.URL, key, []*camera{porch, basement}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %v heartbeats, want 2", len(got))
+	}
+	p, b := got[0], got[1]
+	if p.Camera != "front" || p.Version != version || p.LastUpload.IsZero() || p.LastError != "" || p.TotalBytes == 0 || p.Pending != 2 {
+		t.Errorf("porch heartbeat = %+v", p)
+	}
+	if b.Camera != "basement" || b.LastError != "out of film" || b.LastErrorAt.IsZero() || !b.LastUpload.IsZero() {
+		t.Errorf("basement heartbeat = %+v", b)
+	}
+
+	key.Secret = []byte("wrong")
+	if err := sendHeartbeat(context.Background(), s.URL, key, []*camera{porch}); err == nil {
+		t.Errorf("heartbeat with the wrong key succeeded")
+	}
+}
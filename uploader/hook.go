@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// hookHandler accepts motion's on_movie_end and on_event_end hooks
+// (usually by way of the motionhook command) so a clip can be uploaded
+// as soon as it's finished rather than at the next scan.  Hooks are
+// POSTs with these form values:
+//
+//	camera  the camera's id (may be omitted with only one camera)
+//	event   motion's event number (%v)
+//	file    a file motion wrote for the event (%f); may be repeated
+//
+// Clips that aren't complete yet are left for the watcher or the scan.
+func hookHandler(ctx context.Context, cams []*camera) http.Handler {
+	byID := map[string]*camera{}
+	for _, cam := range cams {
+		byID[cam.ID] = cam
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cam := byID[r.FormValue("camera")]
+		if cam == nil && r.FormValue("camera") == "" && len(cams) == 1 {
+			cam = cams[0]
+		}
+		if cam == nil {
+			http.Error(w, "unknown camera", http.StatusNotFound)
+			return
+		}
+		id, err := cam.hookEvent(r.Form)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		c, err := cam.findClip(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !c.complete() {
+			log.Printf("%v: hook for event %v, but the clip isn't complete yet", cam.ID, id)
+			fmt.Fprintf(w, "event %v is incomplete, leaving it for the scan\n", id)
+			return
+		}
+
+		log.Printf("%v: hook queued %v", cam.ID, c.ovid.Name())
+		ch := clipWork.submit(ctx, cam, c)
+		go func() {
+			if err := <-ch; err != nil {
+				log.Printf("%v: error uploading hooked clip: %v", cam.ID, err)
+			}
+		}()
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "queued %v\n", c.ovid.Name())
+	})
+}
+
+// hookEvent works out which event a hook is about, from the event
+// number if we have it, and otherwise from the files.
+func (cam *camera) hookEvent(form url.Values) (int, error) {
+	id := -1
+	if ev := form.Get("event"); ev != "" {
+		n, err := strconv.Atoi(ev)
+		if err != nil {
+			return 0, fmt.Errorf("invalid event %q", ev)
+		}
+		id = n
+	}
+	for _, fn := range form["file"] {
+		if filepath.IsAbs(fn) && filepath.Dir(fn) != filepath.Clean(cam.Dir) {
+			return 0, fmt.Errorf("%v isn't in %v", fn, cam.Dir)
+		}
+		n, ok := cam.clipID(filepath.Base(fn))
+		if !ok {
+			return 0, fmt.Errorf("%v isn't part of a clip", fn)
+		}
+		if id >= 0 && n != id {
+			return 0, fmt.Errorf("%v isn't part of event %v", fn, id)
+		}
+		id = n
+	}
+	if id < 0 {
+		return 0, fmt.Errorf("need an event or a file")
+	}
+	return id, nil
+}
+
+// findClip gathers whatever files of the given event are on disk.
+func (cam *camera) findClip(id int) (clip, error) {
+	d, err := os.Open(cam.Dir)
+	if err != nil {
+		return clip{}, err
+	}
+	defer d.Close()
+	dents, err := d.Readdir(-1)
+	if err != nil {
+		return clip{}, err
+	}
+	clips := map[int]clip{}
+	for _, dent := range dents {
+		if n, ok := cam.clipID(dent.Name()); ok && n == id {
+			cam.addClipFile(clips, dent)
+		}
+	}
+	return clips[id], nil
+}
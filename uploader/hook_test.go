@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHookEvent(t *testing.T) {
+	cam := &camera{ID: "test", Dir: "/var/lib/motion"}
+	tests := []struct {
+		form url.Values
+		exp  int
+		ok   bool
+	}{
+		{url.Values{"event": {"12"}}, 12, true},
+		{url.Values{"file": {"/var/lib/motion/12-20170518102400.avi"}}, 12, true},
+		{url.Values{"file": {"12-20170518102400-00.jpg"}, "event": {"12"}}, 12, true},
+		{url.Values{"file": {"12-20170518102400.avi"}, "event": {"13"}}, 0, false},
+		{url.Values{"file": {"/elsewhere/12-20170518102400.avi"}}, 0, false},
+		{url.Values{"file": {"lastsnap.jpg"}}, 0, false},
+		{url.Values{"event": {"x"}}, 0, false},
+		{url.Values{}, 0, false},
+	}
+	for _, test := range tests {
+		got, err := cam.hookEvent(test.form)
+		if (err == nil) != test.ok || got != test.exp {
+			t.Errorf("hookEvent(%v) = %v, %v; want %v (ok=%v)", test.form, got, err, test.exp, test.ok)
+		}
+	}
+}
+
+func TestHookIncomplete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "motion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "12-20170518102400.avi"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cam := &camera{ID: "test", Dir: dir}
+	s := httptest.NewServer(hookHandler(context.Background(), []*camera{cam}))
+	defer s.Close()
+
+	tests := []struct {
+		form url.Values
+		exp  int
+	}{
+		{url.Values{"event": {"12"}}, http.StatusOK},
+		{url.Values{"camera": {"test"}, "event": {"12"}}, http.StatusOK},
+		{url.Values{"camera": {"other"}, "event": {"12"}}, http.StatusNotFound},
+		{url.Values{"file": {"nope.txt"}}, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		res, err := http.PostForm(s.URL, test.form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != test.exp {
+			t.Errorf("hook %v = %v, want %v", test.form, res.Status, test.exp)
+		}
+	}
+
+	c, err := cam.findClip(12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ovid == nil || c.complete() {
+		t.Errorf("findClip(12) = %+v, want only the video", c)
+	}
+}
+
+func TestLoopbackOnly(t *testing.T) {
+	h := loopbackOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	}))
+	for addr, exp := range map[string]int{
+		"127.0.0.1:4321":   204,
+		"[::1]:4321":       204,
+		"192.168.1.5:4321": 403,
+		"bogus":            403,
+	} {
+		req := httptest.NewRequest("POST", "/hook", nil)
+		req.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != exp {
+			t.Errorf("request from %v got %v, want %v", addr, w.Code, exp)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	journalPath = flag.String("journal", "", "path to the upload journal (default .uploader.journal in the clip directory)")
+	retryMin    = flag.Duration("retry_min", 30*time.Second, "initial delay before retrying a failed clip")
+	retryMax    = flag.Duration("retry_max", 6*time.Hour, "maximum delay between retries of a failed clip")
+)
+
+// clipState is everything the journal knows about a clip's progress.
+type clipState struct {
+	Key        string            `json:"key"`
+	Discovered time.Time         `json:"discovered"`
+	Transcoded bool              `json:"transcoded,omitempty"`
+	Duration   time.Duration     `json:"duration,omitempty"`
+	Uploaded   map[string]bool   `json:"uploaded,omitempty"`
+	Sessions   map[string]string `json:"sessions,omitempty"`
+	Announced  bool              `json:"announced,omitempty"`
+	Notified   bool              `json:"notified,omitempty"`
+	Cleaned    bool              `json:"cleaned,omitempty"`
+	Filtered   string            `json:"filtered,omitempty"`
+	Attempts   int               `json:"attempts,omitempty"`
+	LastError  string            `json:"last_error,omitempty"`
+	NextTry    time.Time         `json:"next_try,omitempty"`
+}
+
+// finished reports whether the clip needs no more uploads.
+func (st clipState) finished() bool {
+	return st.Filtered != "" || st.Uploaded["mp4"] && st.Uploaded["jpg"] && st.Uploaded["avi"]
+}
+
+// A journal is an append-only log of clip states.  Each line is the
+// complete state of one clip, so the last line for a key wins.
+type journal struct {
+	mu      sync.Mutex
+	fn      string
+	maxAge  time.Duration
+	f       *os.File
+	clips   map[string]*clipState
+	written int
+}
+
+// openJournal opens (or creates) the journal at fn, forgetting about
+// clips discovered more than maxAge ago.
+func openJournal(fn string, maxAge time.Duration) (*journal, error) {
+	j, err := readJournal(fn, maxAge)
+	if err != nil {
+		return nil, err
+	}
+	if err := j.compact(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// readJournal reads the journal at fn without touching it, e.g. while
+// a daemon is writing to it.  It can't record anything.
+func readJournal(fn string, maxAge time.Duration) (*journal, error) {
+	j := &journal{fn: fn, maxAge: maxAge, clips: map[string]*clipState{}}
+
+	f, err := os.Open(fn)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			st := &clipState{}
+			if err := json.Unmarshal(s.Bytes(), st); err != nil {
+				// Most likely a torn write at the end.
+				log.Printf("Skipping bad journal entry %q: %v", s.Text(), err)
+				continue
+			}
+			j.clips[st.Key] = st
+		}
+		f.Close()
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return j, nil
+}
+
+// compact rewrites the journal with only the clips still worth
+// remembering.  Must be called with j.mu held (or before j is shared).
+func (j *journal) compact() error {
+	for k, st := range j.clips {
+		if st.Cleaned || time.Since(st.Discovered) > j.maxAge {
+			delete(j.clips, k)
+		}
+	}
+
+	tmp, err := os.Create(j.fn + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	e := json.NewEncoder(tmp)
+	for _, st := range j.clips {
+		if err := e.Encode(st); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), j.fn); err != nil {
+		return err
+	}
+
+	if j.f != nil {
+		j.f.Close()
+	}
+	j.f, err = os.OpenFile(j.fn, os.O_WRONLY|os.O_APPEND, 0644)
+	j.written = len(j.clips)
+	return err
+}
+
+// setMaxAge changes how long clips are remembered, from the next
+// compaction on.
+func (j *journal) setMaxAge(maxAge time.Duration) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.maxAge = maxAge
+}
+
+// state returns a copy of what we know about the given clip.
+func (j *journal) state(key string) clipState {
+	if j == nil {
+		return clipState{Key: key}
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	st, ok := j.clips[key]
+	if !ok {
+		return clipState{Key: key}
+	}
+	rv := *st
+	rv.Uploaded = map[string]bool{}
+	for k, v := range st.Uploaded {
+		rv.Uploaded[k] = v
+	}
+	rv.Sessions = map[string]string{}
+	for k, v := range st.Sessions {
+		rv.Sessions[k] = v
+	}
+	return rv
+}
+
+// unfinished counts the clips that have yet to be uploaded and
+// announced, including those backing off after failures.
+func (j *journal) unfinished() int {
+	if j == nil {
+		return 0
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	n := 0
+	for _, st := range j.clips {
+		if st.Filtered == "" && !(st.finished() && st.Notified) {
+			n++
+		}
+	}
+	return n
+}
+
+// record applies f to the given clip's state and appends the result
+// to the journal.  Failing to persist only costs us repeated work, so
+// errors are logged rather than returned.
+func (j *journal) record(key string, f func(*clipState)) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	st, ok := j.clips[key]
+	if !ok {
+		st = &clipState{Key: key, Discovered: time.Now()}
+		j.clips[key] = st
+	}
+	if st.Uploaded == nil {
+		st.Uploaded = map[string]bool{}
+	}
+	if st.Sessions == nil {
+		st.Sessions = map[string]string{}
+	}
+	f(st)
+
+	b, err := json.Marshal(st)
+	if err != nil {
+		log.Printf("Error encoding journal entry for %v: %v", key, err)
+		return
+	}
+	if _, err := j.f.Write(append(b, '\n')); err != nil {
+		log.Printf("Error writing journal entry for %v: %v", key, err)
+		return
+	}
+	j.written++
+
+	if j.written > 1000 && j.written > 10*len(j.clips) {
+		if err := j.compact(); err != nil {
+			log.Printf("Error compacting journal: %v", err)
+		}
+	}
+}
+
+// failed records a failed attempt at a clip and schedules the next one.
+func (j *journal) failed(key string, err error) {
+	j.record(key, func(st *clipState) {
+		st.Attempts++
+		st.LastError = err.Error()
+		delay := *retryMin
+		for i := 1; i < st.Attempts && delay < *retryMax; i++ {
+			delay *= 2
+		}
+		if delay > *retryMax {
+			delay = *retryMax
+		}
+		st.NextTry = time.Now().Add(delay)
+	})
+}
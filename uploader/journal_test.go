@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJournalReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "j")
+
+	j, err := openJournal(fn, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.record("a", func(s *clipState) { s.Uploaded["jpg"] = true })
+	j.failed("a", errors.New("broken"))
+	j.failed("a", errors.New("still broken"))
+	j.record("b", func(s *clipState) { s.Cleaned = true })
+
+	j, err = openJournal(fn, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := j.state("a")
+	if !st.Uploaded["jpg"] || st.Uploaded["avi"] {
+		t.Errorf("uploaded = %v, want only jpg", st.Uploaded)
+	}
+	if st.Attempts != 2 || st.LastError != "still broken" {
+		t.Errorf("attempts=%v, last error=%q", st.Attempts, st.LastError)
+	}
+	if wait := time.Until(st.NextTry); wait <= *retryMin || wait > 2**retryMin {
+		t.Errorf("next try in %v, want about %v", wait, 2**retryMin)
+	}
+	if _, ok := j.clips["b"]; ok {
+		t.Errorf("cleaned clip b survived compaction")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpAddr     = flag.String("http", "", "address to serve /metrics, /healthz, /status, /retry and motion's /hook on (e.g. localhost:8080); /retry and /hook only accept requests from localhost")
+	healthWindow = flag.Duration("health_window", 15*time.Minute, "how recently every pass must have succeeded to be healthy")
+)
+
+var (
+	clipsDiscovered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "reye_clips_discovered_total",
+		Help: "Clips found ready for upload.",
+	}, []string{"camera"})
+	clipsUploaded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "reye_clips_uploaded_total",
+		Help: "Clips completely uploaded.",
+	}, []string{"camera"})
+	clipsFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "reye_clips_failed_total",
+		Help: "Failed clip upload attempts.",
+	}, []string{"camera"})
+	clipsSalvaged = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "reye_clips_salvaged_total",
+		Help: "Incomplete clips uploaded with generated parts.",
+	}, []string{"camera"})
+	clipsQuarantined = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "reye_clips_quarantined_total",
+		Help: "Incomplete clips that couldn't be salvaged.",
+	}, []string{"camera"})
+	clipsFiltered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "reye_clips_filtered_total",
+		Help: "Clips dropped by a filter rule.",
+	}, []string{"camera", "rule"})
+	bytesUploaded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "reye_uploaded_bytes_total",
+		Help: "Bytes uploaded by content type.",
+	}, []string{"content_type"})
+	transcodeDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "reye_transcode_seconds",
+		Help:    "Time spent transcoding clips.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	})
+	snapshotLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "reye_snapshot_upload_seconds",
+		Help: "Time taken to upload a snapshot.",
+	})
+	pendingClips = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "reye_pending_clips",
+		Help: "Complete clips waiting to be uploaded as of the last scan.",
+	}, []string{"camera"})
+	lastPass = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "reye_last_success_timestamp_seconds",
+		Help: "When each pass last succeeded.",
+	}, []string{"camera", "pass"})
+)
+
+func init() {
+	prometheus.MustRegister(clipsDiscovered, clipsUploaded, clipsFailed, clipsSalvaged, clipsQuarantined,
+		clipsFiltered, bytesUploaded, transcodeDuration, snapshotLatency, pendingClips, lastPass)
+}
+
+var started = time.Now()
+
+// passes records when each named pass last succeeded.
+var passes = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: map[string]time.Time{}}
+
+func passSucceeded(cam, name string) {
+	now := time.Now()
+	passes.Lock()
+	passes.m[cam+": "+name] = now
+	passes.Unlock()
+	lastPass.WithLabelValues(cam, name).Set(float64(now.Unix()))
+}
+
+// passStarted makes sure a pass that has never succeeded eventually
+// shows up as unhealthy.
+func passStarted(cam, name string) {
+	passes.Lock()
+	defer passes.Unlock()
+	if _, ok := passes.m[cam+": "+name]; !ok {
+		passes.m[cam+": "+name] = time.Time{}
+	}
+}
+
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	passes.Lock()
+	defer passes.Unlock()
+
+	var stale []string
+	for name, t := range passes.m {
+		if time.Since(t) > *healthWindow && time.Since(started) > *healthWindow {
+			stale = append(stale, fmt.Sprintf("%v (last success %v)", name, t.Format(time.RFC3339)))
+		}
+	}
+	if len(stale) > 0 {
+		http.Error(w, fmt.Sprintf("stale passes: %v", stale), 503)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func serveHTTP(ctx context.Context, cams []*camera) {
+	if *httpAddr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", handleHealth)
+	mux.Handle("/status", statusHandler(cams))
+	// Anything that makes us do work only takes orders from this host,
+	// however widely the metrics are exposed.
+	mux.Handle("/hook", loopbackOnly(hookHandler(ctx, cams)))
+	mux.Handle("/retry", loopbackOnly(retryHandler(ctx, cams)))
+	go func() {
+		log.Fatal(http.ListenAndServe(*httpAddr, mux))
+	}()
+}
+
+// loopbackOnly rejects requests to h that don't come from this host.
+func loopbackOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			http.Error(w, "only available from localhost", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
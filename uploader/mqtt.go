@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Just enough MQTT 3.1.1 to publish a message at QoS 1.
+
+const (
+	mqttConnect    = 0x10
+	mqttConnack    = 0x20
+	mqttPublish    = 0x30
+	mqttPuback     = 0x40
+	mqttDisconnect = 0xe0
+)
+
+func mqttString(b *bytes.Buffer, s string) {
+	b.WriteByte(byte(len(s) >> 8))
+	b.WriteByte(byte(len(s)))
+	b.WriteString(s)
+}
+
+func writeMQTTPacket(w io.Writer, header byte, body []byte) error {
+	pkt := []byte{header}
+	n := len(body)
+	for {
+		d := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			d |= 0x80
+		}
+		pkt = append(pkt, d)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(pkt, body...))
+	return err
+}
+
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, mul := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("malformed mqtt length")
+		}
+		d, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n += int(d&0x7f) * mul
+		mul *= 128
+		if d&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+// publishMQTT connects to the broker, publishes one message, and waits
+// for the broker to acknowledge it.
+func publishMQTT(ctx context.Context, broker, clientID, username, password, topic string, payload []byte) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", broker)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	r := bufio.NewReader(conn)
+
+	var b bytes.Buffer
+	mqttString(&b, "MQTT")
+	b.WriteByte(4) // protocol level 3.1.1
+	flags := byte(0x02)
+	if username != "" {
+		flags |= 0x80
+	}
+	if password != "" {
+		flags |= 0x40
+	}
+	b.WriteByte(flags)
+	b.Write([]byte{0, 60})
+	mqttString(&b, clientID)
+	if username != "" {
+		mqttString(&b, username)
+	}
+	if password != "" {
+		mqttString(&b, password)
+	}
+	if err := writeMQTTPacket(conn, mqttConnect, b.Bytes()); err != nil {
+		return err
+	}
+	header, body, err := readMQTTPacket(r)
+	if err != nil {
+		return fmt.Errorf("reading connack: %v", err)
+	}
+	if header != mqttConnack || len(body) != 2 {
+		return fmt.Errorf("expected connack, got %#x", header)
+	}
+	if body[1] != 0 {
+		return fmt.Errorf("broker refused connection (code %v)", body[1])
+	}
+
+	b.Reset()
+	mqttString(&b, topic)
+	b.Write([]byte{0, 1}) // packet id
+	b.Write(payload)
+	if err := writeMQTTPacket(conn, mqttPublish|0x02, b.Bytes()); err != nil {
+		return err
+	}
+	header, body, err = readMQTTPacket(r)
+	if err != nil {
+		return fmt.Errorf("reading puback: %v", err)
+	}
+	if header != mqttPuback || !bytes.Equal(body, []byte{0, 1}) {
+		return fmt.Errorf("expected puback, got %#x %v", header, body)
+	}
+
+	return writeMQTTPacket(conn, mqttDisconnect, nil)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	movieFilename    = flag.String("movie_filename", "%v-%Y%m%d%H%M%S", "motion's movie_filename, or regexp: followed by a regular expression")
+	pictureFilename  = flag.String("picture_filename", "%v-%Y%m%d%H%M%S-%q", "motion's picture_filename, or regexp: followed by a regular expression")
+	snapshotFilename = flag.String("snapshot_filename", "%v-%Y%m%d%H%M%S-snapshot", "motion's snapshot_filename, or regexp: followed by a regular expression")
+	detailsFilename  = flag.String("details_filename", "%v", "name of the details files, or regexp: followed by a regular expression")
+	timezone         = flag.String("timezone", "Local", "timezone of the timestamps in file names")
+)
+
+// A namePattern pulls the event id, time and frame number out of the
+// names motion gives files.  Patterns are either motion's own
+// conversion specifiers (e.g. %v-%Y%m%d%H%M%S) or, after a "regexp:"
+// prefix, a regular expression with any of the named groups event,
+// year, month, day, hour, minute, second, ts (YYYYMMDDHHMMSS) and
+// frame.  Either way they match the whole name less its extension.
+type namePattern struct {
+	re   *regexp.Regexp
+	spec string // the conversion specifiers, if that's how it was given
+}
+
+// nameInfo is what a namePattern found in a name.
+type nameInfo struct {
+	Event int
+	Time  time.Time
+	Frame string
+}
+
+var specifiers = map[byte]string{
+	'v': `(?P<event>\d+)`,
+	'Y': `(?P<year>\d{4})`,
+	'm': `(?P<month>\d{2})`,
+	'd': `(?P<day>\d{2})`,
+	'H': `(?P<hour>\d{2})`,
+	'M': `(?P<minute>\d{2})`,
+	'S': `(?P<second>\d{2})`,
+	'T': `(?P<hour>\d{2}):(?P<minute>\d{2}):(?P<second>\d{2})`,
+	'q': `(?P<frame>\d+)`,
+	't': `\d+`,
+	'$': `.+?`,
+	'%': `%`,
+}
+
+func compilePattern(s string) (*namePattern, error) {
+	if strings.HasPrefix(s, "regexp:") {
+		re, err := regexp.Compile("^(?:" + strings.TrimPrefix(s, "regexp:") + ")$")
+		if err != nil {
+			return nil, err
+		}
+		return &namePattern{re: re}, nil
+	}
+
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b.WriteString(regexp.QuoteMeta(s[i : i+1]))
+			continue
+		}
+		if i++; i == len(s) {
+			return nil, fmt.Errorf("%q ends with a bare %%", s)
+		}
+		re, ok := specifiers[s[i]]
+		if !ok {
+			return nil, fmt.Errorf("unsupported conversion %%%c in %q", s[i], s)
+		}
+		b.WriteString(re)
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, fmt.Errorf("%q: %v", s, err)
+	}
+	return &namePattern{re: re, spec: s}, nil
+}
+
+func mustCompilePattern(s string) *namePattern {
+	p, err := compilePattern(s)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// parse extracts what it can from name (with or without an extension),
+// reading times in loc.
+func (p *namePattern) parse(name string, loc *time.Location) (nameInfo, error) {
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	m := p.re.FindStringSubmatch(base)
+	if m == nil {
+		return nameInfo{}, fmt.Errorf("%v doesn't match %v", name, p.re)
+	}
+
+	groups := map[string]string{}
+	for i, n := range p.re.SubexpNames() {
+		if n != "" && m[i] != "" {
+			groups[n] = m[i]
+		}
+	}
+
+	rv := nameInfo{Event: -1, Frame: groups["frame"]}
+	if ev, ok := groups["event"]; ok {
+		n, err := strconv.Atoi(ev)
+		if err != nil {
+			return nameInfo{}, fmt.Errorf("parsing event from %v: %v", name, err)
+		}
+		rv.Event = n
+	}
+
+	if ts, ok := groups["ts"]; ok {
+		t, err := time.ParseInLocation(clipTimeFmt, ts, loc)
+		if err != nil {
+			return nameInfo{}, fmt.Errorf("parsing timestamp from %v: %v", name, err)
+		}
+		rv.Time = t
+	} else if _, ok := groups["year"]; ok {
+		var f [6]int
+		for i, n := range []string{"year", "month", "day", "hour", "minute", "second"} {
+			if v, ok := groups[n]; ok {
+				f[i], _ = strconv.Atoi(v)
+			}
+		}
+		if f[1] < 1 || f[1] > 12 || f[2] < 1 || f[2] > 31 || f[3] > 23 || f[4] > 59 || f[5] > 60 {
+			return nameInfo{}, fmt.Errorf("invalid timestamp in %v", name)
+		}
+		rv.Time = time.Date(f[0], time.Month(f[1]), f[2], f[3], f[4], f[5], 0, loc)
+	}
+	return rv, nil
+}
+
+// format names a file (less its extension) the way motion would have
+// for info.  Regular expressions, and specifiers we can't fill in from
+// info, can't be formatted.
+func (p *namePattern) format(info nameInfo) (string, error) {
+	if p.spec == "" {
+		return "", fmt.Errorf("can't make a name from %v", p.re)
+	}
+	var b strings.Builder
+	for i := 0; i < len(p.spec); i++ {
+		if p.spec[i] != '%' {
+			b.WriteByte(p.spec[i])
+			continue
+		}
+		i++
+		switch c := p.spec[i]; c {
+		case 'v':
+			fmt.Fprintf(&b, "%d", info.Event)
+		case 'Y', 'm', 'd', 'H', 'M', 'S', 'T':
+			if info.Time.IsZero() {
+				return "", fmt.Errorf("can't make a name from %q without a time", p.spec)
+			}
+			b.WriteString(info.Time.Format(map[byte]string{
+				'Y': "2006", 'm': "01", 'd': "02", 'H': "15", 'M': "04", 'S': "05", 'T': "15:04:05",
+			}[c]))
+		case 'q':
+			if info.Frame == "" {
+				return "", fmt.Errorf("can't make a name from %q without a frame", p.spec)
+			}
+			b.WriteString(info.Frame)
+		case '%':
+			b.WriteByte('%')
+		default:
+			return "", fmt.Errorf("can't make a name from %q: %%%c", p.spec, c)
+		}
+	}
+	return b.String(), nil
+}
+
+// naming is how a camera's files are named.
+type naming struct {
+	movie, picture, snapshot, details *namePattern
+	loc                               *time.Location
+}
+
+// defaultNaming is motion's default naming, used for cameras that
+// haven't been set up otherwise.
+var defaultNaming = &naming{
+	movie:    mustCompilePattern("%v-%Y%m%d%H%M%S"),
+	picture:  mustCompilePattern("%v-%Y%m%d%H%M%S-%q"),
+	snapshot: mustCompilePattern("%v-%Y%m%d%H%M%S-snapshot"),
+	details:  mustCompilePattern("%v"),
+	loc:      time.Local,
+}
+
+// compileNaming sets up the camera's naming from its config.
+func (cam *camera) compileNaming() error {
+	n := &naming{}
+	for _, p := range []struct {
+		dest **namePattern
+		src  string
+		name string
+	}{
+		{&n.movie, cam.MovieFilename, "movie_filename"},
+		{&n.picture, cam.PictureFilename, "picture_filename"},
+		{&n.snapshot, cam.SnapshotFilename, "snapshot_filename"},
+		{&n.details, cam.DetailsFilename, "details_filename"},
+	} {
+		np, err := compilePattern(p.src)
+		if err != nil {
+			return fmt.Errorf("%v: %v: %v", cam.ID, p.name, err)
+		}
+		*p.dest = np
+	}
+	for _, p := range []*namePattern{n.movie, n.picture, n.details} {
+		if !hasGroup(p.re, "event") {
+			return fmt.Errorf("%v: %v doesn't include the event number", cam.ID, p.re)
+		}
+	}
+	if !hasGroup(n.movie.re, "ts") && !hasGroup(n.movie.re, "year") {
+		return fmt.Errorf("%v: %v doesn't include a timestamp", cam.ID, n.movie.re)
+	}
+	if !hasGroup(n.snapshot.re, "ts") && !hasGroup(n.snapshot.re, "year") {
+		return fmt.Errorf("%v: %v doesn't include a timestamp", cam.ID, n.snapshot.re)
+	}
+
+	loc, err := time.LoadLocation(cam.Timezone)
+	if err != nil {
+		return fmt.Errorf("%v: %v", cam.ID, err)
+	}
+	n.loc = loc
+	cam.names = n
+	return nil
+}
+
+func hasGroup(re *regexp.Regexp, name string) bool {
+	for _, n := range re.SubexpNames() {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (cam *camera) naming() *naming {
+	if cam.names == nil {
+		return defaultNaming
+	}
+	return cam.names
+}
+
+// isSnapshot reports whether name is one of motion's snapshots (or the
+// link to the latest one).
+func (cam *camera) isSnapshot(name string) bool {
+	if name == "lastsnap.jpg" {
+		return true
+	}
+	_, err := cam.naming().snapshot.parse(name, time.UTC)
+	return strings.HasSuffix(name, ".jpg") && err == nil
+}
+
+// parseClipInfo returns the event id and time of a clip's video or
+// thumbnail.  Thumbnails we generated ourselves are named after the
+// video.
+func (cam *camera) parseClipInfo(name string) (nameInfo, error) {
+	n := cam.naming()
+	switch {
+	case strings.HasSuffix(name, "-salvaged.jpg"):
+		return n.movie.parse(strings.TrimSuffix(name, "-salvaged.jpg"), n.loc)
+	case strings.HasSuffix(name, ".jpg"):
+		return n.picture.parse(name, n.loc)
+	}
+	return n.movie.parse(name, n.loc)
+}
+
+func (cam *camera) parseSnapshotTime(name string) (time.Time, error) {
+	info, err := cam.naming().snapshot.parse(name, cam.naming().loc)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.Time, nil
+}
+
+// clipID returns the motion event id of a clip's thumbnail, video or
+// details file.
+func (cam *camera) clipID(name string) (int, bool) {
+	switch {
+	case cam.isSnapshot(name):
+		return 0, false
+	case strings.HasSuffix(name, ".details"):
+		info, err := cam.naming().details.parse(name, time.UTC)
+		return info.Event, err == nil
+	case strings.HasSuffix(name, ".avi"), strings.HasSuffix(name, ".jpg"):
+		info, err := cam.parseClipInfo(name)
+		return info.Event, err == nil
+	}
+	return 0, false
+}
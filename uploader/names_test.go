@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNamePatterns(t *testing.T) {
+	utc := time.UTC
+	tests := []struct {
+		pattern, name string
+		event         int
+		ts            string
+		frame         string
+	}{
+		{"%v-%Y%m%d%H%M%S", "26-20170518102400.avi", 26, "2017-05-18T10:24:00Z", ""},
+		{"%v-%Y%m%d%H%M%S-%q", "26-20170518102400-07.jpg", 26, "2017-05-18T10:24:00Z", "07"},
+		{"%v-%Y%m%d%H%M%S-snapshot", "26-20170518102400-snapshot.jpg", 26, "2017-05-18T10:24:00Z", ""},
+		{"%t-%v-%Y%m%d%H%M%S", "1-26-20170518102400.mkv", 26, "2017-05-18T10:24:00Z", ""},
+		{"%$/%Y-%m-%d/%T-%v", "porch/2017-05-18/10:24:00-26", 26, "2017-05-18T10:24:00Z", ""},
+		{"cam_%Y%m%d_%H%M%S_ev%v_%q", "cam_20170518_102400_ev9_123.jpg", 9, "2017-05-18T10:24:00Z", "123"},
+		{"%v", "26.details", 26, "", ""},
+		{"100%%-%v-%Y%m%d%H%M%S", "100%-5-20170518102400.avi", 5, "2017-05-18T10:24:00Z", ""},
+		{`regexp:ev(?P<event>\d+)_(?P<ts>\d{14})`, "ev4_20170518102400.avi", 4, "2017-05-18T10:24:00Z", ""},
+		{`regexp:(?P<year>\d{4})/(?P<month>\d\d)/(?P<day>\d\d)/(?P<event>\d+)-(?P<frame>\d+)`,
+			"2017/05/18/3-2.jpg", 3, "2017-05-18T00:00:00Z", "2"},
+	}
+	for _, test := range tests {
+		p, err := compilePattern(test.pattern)
+		if err != nil {
+			t.Errorf("compilePattern(%q): %v", test.pattern, err)
+			continue
+		}
+		info, err := p.parse(test.name, utc)
+		if err != nil {
+			t.Errorf("parse(%q, %q): %v", test.pattern, test.name, err)
+			continue
+		}
+		ts := ""
+		if !info.Time.IsZero() {
+			ts = info.Time.Format(time.RFC3339)
+		}
+		if info.Event != test.event || ts != test.ts || info.Frame != test.frame {
+			t.Errorf("parse(%q, %q) = %+v (%v), want event=%v ts=%v frame=%q",
+				test.pattern, test.name, info, ts, test.event, test.ts, test.frame)
+		}
+	}
+}
+
+func TestNamePatternMismatches(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+	}{
+		{"%v-%Y%m%d%H%M%S", "26-20170518102400-07.jpg"},
+		{"%v-%Y%m%d%H%M%S-%q", "26-20170518102400-snapshot.jpg"},
+		{"%v-%Y%m%d%H%M%S", "lastsnap.jpg"},
+		{"%v-%Y%m%d%H%M%S", "26-20171318102400.avi"},
+	}
+	for _, test := range tests {
+		p := mustCompilePattern(test.pattern)
+		if info, err := p.parse(test.name, time.UTC); err == nil {
+			t.Errorf("parse(%q, %q) = %+v, want error", test.pattern, test.name, info)
+		}
+	}
+
+	for _, bad := range []string{"%v-%x", "trailing%", "regexp:("} {
+		if _, err := compilePattern(bad); err == nil {
+			t.Errorf("compilePattern(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestCameraNaming(t *testing.T) {
+	cam := &camera{ID: "test", MovieFilename: "%Y%m%d-%H%M%S-%v", PictureFilename: "%Y%m%d-%H%M%S-%v-%q",
+		SnapshotFilename: "snap-%Y%m%d%H%M%S", Timezone: "UTC"}
+	cam.applyDefaults()
+	if err := cam.compileNaming(); err != nil {
+		t.Fatal(err)
+	}
+
+	clips := map[int]clip{}
+	for _, fn := range []string{"20170518-102400-26.avi", "20170518-102400-26-03.jpg", "26.details", "snap-20170518102400.jpg"} {
+		cam.addClipFile(clips, fakeFile(fn))
+	}
+	c := clips[26]
+	if len(clips) != 1 || c.ovid == nil || c.thumb == nil || c.frame != "03" ||
+		c.ts != time.Date(2017, 5, 18, 10, 24, 0, 0, time.UTC) {
+		t.Errorf("clips = %+v", clips)
+	}
+	if !cam.isSnapshot("snap-20170518102400.jpg") || cam.isSnapshot("20170518-102400-26-03.jpg") {
+		t.Errorf("snapshot detection is confused")
+	}
+
+	cam.MovieFilename = "%Y%m%d-%H%M%S"
+	if err := cam.compileNaming(); err == nil {
+		t.Errorf("movie pattern without an event compiled")
+	}
+}
+
+// fakeFile is the os.FileInfo of a file that needn't exist.
+type fakeFile string
+
+func (f fakeFile) Name() string       { return string(f) }
+func (f fakeFile) Size() int64        { return 0 }
+func (f fakeFile) Mode() os.FileMode  { return 0644 }
+func (f fakeFile) ModTime() time.Time { return time.Time{} }
+func (f fakeFile) IsDir() bool        { return false }
+func (f fakeFile) Sys() interface{}   { return nil }
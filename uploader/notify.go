@@ -0,0 +1,636 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/httputil"
+	"github.com/dustin/reye/logging"
+	"github.com/dustin/reye/sign"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var notifyTimeout = flag.Duration("notify_timeout", 10*time.Second, "deadline for each notification attempt")
+
+const (
+	defaultQueueSize = 100
+	defaultAttempts  = 10
+	notifyRetryMin   = time.Second
+	notifyRetryMax   = 5 * time.Minute
+)
+
+var notificationsSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "reye_notifications_total",
+	Help: "Notification attempts by sink and result.",
+}, []string{"sink", "result"})
+
+func init() {
+	prometheus.MustRegister(notificationsSent)
+}
+
+// Clips are announced twice: once its thumbnail is up (pending) and
+// again when everything is (complete).
+const (
+	statusPending  = "pending"
+	statusComplete = "complete"
+)
+
+// An upload is what notifiers are told about a newly uploaded clip.
+type upload struct {
+	Camera   string            `json:"camera"`
+	Prefix   string            `json:"prefix"`
+	ID       string            `json:"id"`
+	Status   string            `json:"status"`
+	Captured time.Time         `json:"captured"`
+	Duration string            `json:"duration,omitempty"`
+	Objects  map[string]string `json:"objects"`
+	Details  map[string]string `json:"details,omitempty"`
+
+	ack func(delivered bool) // told how each sink fared, if set
+}
+
+// acked tells whoever sent u whether a sink got it.
+func (u upload) acked(delivered bool) {
+	if u.ack != nil {
+		u.ack(delivered)
+	}
+}
+
+// announcement describes a clip's upload with the given status.
+func (cam *camera) announcement(c clip, status string, dur time.Duration, withAVI bool) upload {
+	key := c.key()
+	u := upload{
+		Camera:   cam.ID,
+		Prefix:   cam.appID(),
+		ID:       key,
+		Status:   status,
+		Captured: c.ts,
+		Objects:  map[string]string{"jpg": cam.objectName(key + ".jpg")},
+		Details:  c.details,
+	}
+	if status == statusComplete {
+		u.Duration = dur.String()
+		u.Objects["mp4"] = cam.objectName(key + ".mp4")
+	}
+	if withAVI {
+		u.Objects["avi"] = cam.objectName(key + ".avi")
+	}
+	return u
+}
+
+// A notifier tells something about new uploads.
+type notifier interface {
+	Notify(ctx context.Context, u upload) error
+}
+
+// sinkConfig describes a notification sink in the -config file, e.g.:
+//
+//	notify:
+//	  - type: webhook
+//	    url: https://example.com/reye
+//	  - type: mqtt
+//	    broker: localhost:1883
+//	    topic: reye/uploads
+//	  - type: smtp
+//	    addr: smtp.example.com:587
+//	    from: reye@example.com
+//	    to: [me@example.com]
+//
+// Sinks listed at the top level get uploads from every camera; a
+// camera's own notify list is added to those.  Sinks only hear about
+// complete uploads unless pending is set.
+type sinkConfig struct {
+	Type     string            `yaml:"type"`
+	Name     string            `yaml:"name"`
+	Pending  bool              `yaml:"pending"`
+	Queue    int               `yaml:"queue"`
+	Attempts int               `yaml:"attempts"`
+	URL      string            `yaml:"url"`
+	Auth     string            `yaml:"auth"`
+	Headers  map[string]string `yaml:"headers"`
+	Broker   string            `yaml:"broker"`
+	Topic    string            `yaml:"topic"`
+	ClientID string            `yaml:"client_id"`
+	Addr     string            `yaml:"addr"`
+	From     string            `yaml:"from"`
+	To       []string          `yaml:"to"`
+	Username string            `yaml:"username"`
+	Password string            `yaml:"password"`
+}
+
+func (sc *sinkConfig) notifier() (notifier, error) {
+	switch sc.Type {
+	case "reye":
+		if sc.URL == "" {
+			return nil, fmt.Errorf("reye sink needs a url")
+		}
+		k, err := sign.ParseKey(sc.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("reye sink: %v", err)
+		}
+		return &reyeNotifier{url: sc.URL, key: k}, nil
+	case "webhook":
+		if sc.URL == "" {
+			return nil, fmt.Errorf("webhook sink needs a url")
+		}
+		return &webhookNotifier{url: sc.URL, headers: sc.Headers}, nil
+	case "mqtt":
+		if sc.Broker == "" {
+			return nil, fmt.Errorf("mqtt sink needs a broker")
+		}
+		n := &mqttNotifier{broker: sc.Broker, topic: sc.Topic, clientID: sc.ClientID,
+			username: sc.Username, password: sc.Password}
+		if n.topic == "" {
+			n.topic = "reye/uploads"
+		}
+		if n.clientID == "" {
+			n.clientID = "reye-uploader"
+		}
+		return n, nil
+	case "smtp":
+		if sc.Addr == "" || sc.From == "" || len(sc.To) == 0 {
+			return nil, fmt.Errorf("smtp sink needs an addr, from and to")
+		}
+		return &smtpNotifier{addr: sc.Addr, from: sc.From, to: sc.To,
+			username: sc.Username, password: sc.Password}, nil
+	}
+	return nil, fmt.Errorf("unknown sink type %q", sc.Type)
+}
+
+func (sc *sinkConfig) name() string {
+	if sc.Name != "" {
+		return sc.Name
+	}
+	return sc.Type
+}
+
+// reyeNotifier is the app's own /api/newfile trigger.
+type reyeNotifier struct {
+	url string
+	key sign.Key
+}
+
+func (n *reyeNotifier) Notify(ctx context.Context, u upload) error {
+	// The app knows cameras by their prefix.
+	cam := u.Prefix
+	if cam == "" {
+		cam = u.Camera
+	}
+	v := url.Values{"cam": {cam}, "id": {u.ID}, "status": {u.Status},
+		"captured": {u.Captured.Format(time.RFC3339)}}
+	if u.Duration != "" {
+		v.Set("duration", u.Duration)
+	}
+	body := []byte(v.Encode())
+	req, err := http.NewRequest("POST", n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+	if err := sign.Sign(req, body, n.key, time.Now()); err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 201 {
+		return httputil.HTTPError(res)
+	}
+	return nil
+}
+
+// webhookNotifier POSTs each upload as JSON.
+type webhookNotifier struct {
+	url     string
+	headers map[string]string
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, u upload) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", n.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "application/json")
+	for k, v := range n.headers {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return httputil.HTTPError(res)
+	}
+	return nil
+}
+
+// mqttNotifier publishes each upload as JSON to <topic>/<camera>.
+type mqttNotifier struct {
+	broker, topic, clientID string
+	username, password      string
+}
+
+func (n *mqttNotifier) Notify(ctx context.Context, u upload) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return publishMQTT(ctx, n.broker, n.clientID, n.username, n.password, n.topic+"/"+u.Camera, b)
+}
+
+// smtpNotifier mails a short description of each upload.
+type smtpNotifier struct {
+	addr, from         string
+	to                 []string
+	username, password string
+}
+
+func (n *smtpNotifier) message(u upload) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %v\r\n", n.from)
+	fmt.Fprintf(&b, "To: %v\r\n", strings.Join(n.to, ", "))
+	subject := fmt.Sprintf("Motion on %v at %v", u.Camera, u.Captured.Format(time.Kitchen))
+	if u.Status == statusPending {
+		subject += " (processing)"
+	}
+	fmt.Fprintf(&b, "Subject: %v\r\n", subject)
+	fmt.Fprintf(&b, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&b, "Camera: %v\r\nCaptured: %v\r\n", u.Camera, u.Captured.Format(time.RFC3339))
+	if u.Duration != "" {
+		fmt.Fprintf(&b, "Duration: %v\r\n", u.Duration)
+	}
+	for _, m := range []map[string]string{u.Objects, u.Details} {
+		var keys []string
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&b, "%v: %v\r\n", k, m[k])
+		}
+	}
+	return b.Bytes()
+}
+
+func (n *smtpNotifier) Notify(ctx context.Context, u upload) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", n.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	host, _, err := net.SplitHostPort(n.addr)
+	if err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if n.username != "" {
+		if err := c.Auth(smtp.PlainAuth("", n.username, n.password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(n.from); err != nil {
+		return err
+	}
+	for _, to := range n.to {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(n.message(u)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// A sinkQueue delivers notifications to one sink in order, retrying
+// each with backoff, so a slow or broken sink doesn't hold up uploads
+// or any other sink.
+type sinkQueue struct {
+	name     string
+	n        notifier
+	attempts int
+	pending  bool
+	grace    time.Duration // how long to keep delivering once we're stopping
+	ch       chan upload
+	inflight sync.WaitGroup
+}
+
+func newSinkQueue(name string, n notifier, size, attempts int, pending bool) *sinkQueue {
+	if size <= 0 {
+		size = defaultQueueSize
+	}
+	if attempts <= 0 {
+		attempts = defaultAttempts
+	}
+	return &sinkQueue{name: name, n: n, attempts: attempts, pending: pending, grace: *grace,
+		ch: make(chan upload, size)}
+}
+
+// logger is the log for notifying this queue's sink about u.
+func (q *sinkQueue) logger(u upload) *slog.Logger {
+	return slog.Default().With(logging.Camera, u.Camera, logging.Clip, u.ID, logging.Phase, "notify",
+		"sink", q.name, "status", u.Status)
+}
+
+// enqueue adds u to the queue, dropping it if the queue is full.
+func (q *sinkQueue) enqueue(u upload) {
+	q.inflight.Add(1)
+	select {
+	case q.ch <- u:
+	default:
+		q.inflight.Done()
+		q.drop(u, "notification queue is full, dropping")
+	}
+}
+
+// drop gives up on u without delivering it.
+func (q *sinkQueue) drop(u upload, why string) {
+	q.logger(u).Warn(why)
+	notificationsSent.WithLabelValues(q.name, "dropped").Inc()
+	u.acked(false)
+}
+
+// run delivers what's queued until ctx is done, then drains the rest.
+func (q *sinkQueue) run(ctx context.Context) {
+	for {
+		select {
+		case u := <-q.ch:
+			u.acked(q.deliver(ctx, u))
+			q.inflight.Done()
+		case <-ctx.Done():
+			q.drain()
+			return
+		}
+	}
+}
+
+// drain delivers whatever's still queued, giving up on it after the
+// queue's grace period.  Anything it can't get to is logged and counted
+// as dropped.
+func (q *sinkQueue) drain() {
+	ctx, cancel := context.WithTimeout(context.Background(), q.grace)
+	defer cancel()
+	for {
+		select {
+		case u := <-q.ch:
+			if ctx.Err() != nil {
+				q.drop(u, "shutting down, dropping undelivered notification")
+			} else {
+				u.acked(q.deliver(ctx, u))
+			}
+			q.inflight.Done()
+		default:
+			return
+		}
+	}
+}
+
+// deliver sends u to the sink, reporting whether it got there.
+func (q *sinkQueue) deliver(ctx context.Context, u upload) bool {
+	delay := notifyRetryMin
+	for attempt := 1; ; attempt++ {
+		nctx, cancel := context.WithTimeout(ctx, *notifyTimeout)
+		err := q.n.Notify(nctx, u)
+		cancel()
+		if err == nil {
+			notificationsSent.WithLabelValues(q.name, "ok").Inc()
+			q.logger(u).Info("notified", "attempt", attempt)
+			return true
+		}
+		notificationsSent.WithLabelValues(q.name, "error").Inc()
+		if attempt >= q.attempts {
+			q.logger(u).Error("giving up notifying", "attempt", attempt, "error", err)
+			return false
+		}
+		q.logger(u).Warn("error notifying", "attempt", attempt, "retry_in", delay, "error", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return false
+		}
+		if delay *= 2; delay > notifyRetryMax {
+			delay = notifyRetryMax
+		}
+	}
+}
+
+// triggers are the queues for the reye triggers, by URL.  Cameras with
+// the same trigger URL share its queue.
+var triggers struct {
+	sync.Mutex
+	ctx context.Context // nil until the notifiers are started
+	m   map[string]*sinkQueue
+}
+
+// triggerQueue returns the queue for the trigger at u, starting it if
+// need be.  triggers must be locked.
+func triggerQueue(u string) (*sinkQueue, error) {
+	if q, ok := triggers.m[u]; ok {
+		return q, nil
+	}
+	k, err := sign.ParseKey(*triggerAuth)
+	if err != nil {
+		return nil, fmt.Errorf("-triggerAuth: %v", err)
+	}
+	q := newSinkQueue("reye "+u, &reyeNotifier{url: u, key: k}, 0, 0, true)
+	triggers.m[u] = q
+	go q.run(triggers.ctx)
+	return q, nil
+}
+
+// setTrigger points the camera's reye trigger at u (or nowhere, if
+// it's empty).  Before the notifiers are started, there's nothing to
+// do; they'll pick it up.
+func (cam *camera) setTrigger(u string) error {
+	triggers.Lock()
+	defer triggers.Unlock()
+	if triggers.ctx == nil {
+		return nil
+	}
+	var q *sinkQueue
+	if u != "" {
+		var err error
+		if q, err = triggerQueue(u); err != nil {
+			return err
+		}
+	}
+	cam.remote.mu.Lock()
+	defer cam.remote.mu.Unlock()
+	cam.remote.trigger = q
+	return nil
+}
+
+// sinkQueues are all the queues the camera notifies: its reye trigger,
+// if it has one, then the sinks it's configured with.
+func (cam *camera) sinkQueues() []*sinkQueue {
+	cam.remote.mu.Lock()
+	defer cam.remote.mu.Unlock()
+	if cam.remote.trigger == nil {
+		return cam.sinks
+	}
+	return append([]*sinkQueue{cam.remote.trigger}, cam.sinks...)
+}
+
+// startNotifiers creates a queue for each distinct sink the cameras use
+// and starts delivering to them.  The reye trigger from trigger_url
+// (or -triggerURL, or the app's config) is always one of them when
+// it's set.
+func startNotifiers(ctx context.Context, cams []*camera) error {
+	triggers.Lock()
+	triggers.ctx, triggers.m = ctx, map[string]*sinkQueue{}
+	triggers.Unlock()
+
+	byConf := map[*sinkConfig]*sinkQueue{}
+	for _, cam := range cams {
+		cam.sinks = nil
+		if err := cam.setTrigger(cam.settings().TriggerURL); err != nil {
+			return err
+		}
+		for _, sc := range cam.Notify {
+			q, ok := byConf[sc]
+			if !ok {
+				n, err := sc.notifier()
+				if err != nil {
+					return fmt.Errorf("%v: %v", cam.ID, err)
+				}
+				// The app always wants to know about pending events.
+				q = newSinkQueue(sc.name(), n, sc.Queue, sc.Attempts, sc.Pending || sc.Type == "reye")
+				byConf[sc] = q
+				go q.run(ctx)
+			}
+			cam.sinks = append(cam.sinks, q)
+		}
+	}
+	return nil
+}
+
+// drainNotifiers waits (up to -grace) for everything the cameras have
+// queued to be delivered, for commands that are about to exit.
+func drainNotifiers(cams []*camera) {
+	done := make(chan struct{})
+	go func() {
+		for _, cam := range cams {
+			for _, q := range cam.sinkQueues() {
+				q.inflight.Wait()
+			}
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(*grace):
+		log.Printf("Gave up waiting for notifications after %v", *grace)
+	}
+}
+
+// notify queues u for every sink the camera sends to.  Once they've
+// all had a go, done (if not nil) is told whether every one of them
+// got it.
+func (cam *camera) notify(u upload, done func(delivered bool)) {
+	var qs []*sinkQueue
+	for _, q := range cam.sinkQueues() {
+		if u.Status == statusPending && !q.pending {
+			continue
+		}
+		qs = append(qs, q)
+	}
+	if done == nil {
+		done = func(bool) {}
+	}
+	if len(qs) == 0 {
+		done(true)
+		return
+	}
+
+	var mu sync.Mutex
+	left, ok := len(qs), true
+	u.ack = func(delivered bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		ok = ok && delivered
+		if left--; left == 0 {
+			done(ok)
+		}
+	}
+	for _, q := range qs {
+		q.enqueue(u)
+	}
+}
+
+// announcements are the clip announcements still being delivered, so
+// they aren't queued again in the meantime.
+type announcements struct {
+	mu sync.Mutex
+	m  map[string]bool
+}
+
+// announce notifies the camera's sinks of the clip stored under key,
+// calling delivered once they've all got it.  Until then, the journal
+// shouldn't say it's been announced, so it's announced again on the
+// next pass (or after a restart) and sinks hear about each clip at
+// least once.
+func (cam *camera) announce(key string, u upload, delivered func()) {
+	id := key + " " + u.Status
+	a := &cam.announcing
+	a.mu.Lock()
+	if a.m[id] {
+		a.mu.Unlock()
+		return
+	}
+	if a.m == nil {
+		a.m = map[string]bool{}
+	}
+	a.m[id] = true
+	a.mu.Unlock()
+
+	cam.notify(u, func(ok bool) {
+		if ok {
+			delivered()
+		}
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		delete(a.m, id)
+	})
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dustin/reye/sign"
+)
+
+var testUpload = upload{
+	Camera:   "porch",
+	ID:       "20170518102400",
+	Status:   statusComplete,
+	Captured: time.Date(2017, 5, 18, 10, 24, 0, 0, time.UTC),
+	Duration: "12s",
+	Objects:  map[string]string{"mp4": "porch/20170518102400.mp4"},
+}
+
+func TestReyeNotifier(t *testing.T) {
+	key := sign.Key{ID: "k1", Secret: []byte("sekrit")}
+	v := &sign.Verifier{Keys: []sign.Key{key}, MaxSkew: time.Minute}
+	var got string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := v.Verify(r, body, time.Now()); err != nil {
+			http.Error(w, err.Error(), 401)
+			return
+		}
+		form, _ := url.ParseQuery(string(body))
+		got = form.Get("cam") + " " + form.Get("id") + " " + form.Get("status") + " " + form.Get("duration")
+		w.WriteHeader(201)
+	}))
+	defer s.Close()
+
+	n := &reyeNotifier{url: s.URL, key: key}
+	if err := n.Notify(context.Background(), testUpload); err != nil {
+		t.Fatal(err)
+	}
+	if want := "porch 20170518102400 complete 12s"; got != want {
+		t.Errorf("trigger got %q, want %q", got, want)
+	}
+
+	// The app knows cameras by their prefix.
+	u := testUpload
+	u.Prefix = "front"
+	if err := n.Notify(context.Background(), u); err != nil {
+		t.Fatal(err)
+	}
+	if want := "front 20170518102400 complete 12s"; got != want {
+		t.Errorf("trigger got %q, want %q", got, want)
+	}
+
+	n.key.Secret = []byte("wrong")
+	if err := n.Notify(context.Background(), testUpload); err == nil {
+		t.Errorf("trigger with the wrong key succeeded")
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var got upload
+	var hdr string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hdr = r.Header.Get("x-token")
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decoding webhook: %v", err)
+		}
+	}))
+	defer s.Close()
+
+	n := &webhookNotifier{url: s.URL, headers: map[string]string{"x-token": "t"}}
+	if err := n.Notify(context.Background(), testUpload); err != nil {
+		t.Fatal(err)
+	}
+	if hdr != "t" || got.ID != testUpload.ID || got.Objects["mp4"] != testUpload.Objects["mp4"] {
+		t.Errorf("webhook got %+v (x-token=%q)", got, hdr)
+	}
+}
+
+func TestMQTTNotifier(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	type msg struct {
+		topic   string
+		payload []byte
+		err     error
+	}
+	got := make(chan msg, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			got <- msg{err: err}
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		if h, _, err := readMQTTPacket(r); err != nil || h != mqttConnect {
+			got <- msg{err: fmt.Errorf("expected connect, got %#x, %v", h, err)}
+			return
+		}
+		writeMQTTPacket(conn, mqttConnack, []byte{0, 0})
+		h, body, err := readMQTTPacket(r)
+		if err != nil || h&0xf0 != mqttPublish {
+			got <- msg{err: fmt.Errorf("expected publish, got %#x, %v", h, err)}
+			return
+		}
+		tl := int(body[0])<<8 | int(body[1])
+		writeMQTTPacket(conn, mqttPuback, body[2+tl:4+tl])
+		got <- msg{topic: string(body[2 : 2+tl]), payload: body[4+tl:]}
+		readMQTTPacket(r)
+	}()
+
+	n := &mqttNotifier{broker: l.Addr().String(), topic: "reye/uploads", clientID: "test"}
+	if err := n.Notify(context.Background(), testUpload); err != nil {
+		t.Fatal(err)
+	}
+	m := <-got
+	if m.err != nil {
+		t.Fatal(m.err)
+	}
+	var u upload
+	if err := json.Unmarshal(m.payload, &u); err != nil {
+		t.Fatalf("decoding payload %q: %v", m.payload, err)
+	}
+	if m.topic != "reye/uploads/porch" || u.ID != testUpload.ID {
+		t.Errorf("published %+v to %v", u, m.topic)
+	}
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	got := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		fmt.Fprintf(conn, "220 localhost\r\n")
+		var data []string
+		for inData := false; ; {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				got <- strings.Join(data, "")
+				return
+			}
+			switch {
+			case inData && line == ".\r\n":
+				inData = false
+				fmt.Fprintf(conn, "250 queued\r\n")
+			case inData:
+				data = append(data, line)
+			case strings.HasPrefix(line, "DATA"):
+				inData = true
+				fmt.Fprintf(conn, "354 go ahead\r\n")
+			case strings.HasPrefix(line, "QUIT"):
+				fmt.Fprintf(conn, "221 bye\r\n")
+				got <- strings.Join(data, "")
+				return
+			default:
+				fmt.Fprintf(conn, "250 ok\r\n")
+			}
+		}
+	}()
+
+	n := &smtpNotifier{addr: l.Addr().String(), from: "reye@example.com", to: []string{"me@example.com"}}
+	if err := n.Notify(context.Background(), testUpload); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-got
+	for _, want := range []string{"To: me@example.com", "Subject: Motion on porch", "mp4: porch/20170518102400.mp4"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("message is missing %q:\n%v", want, msg)
+		}
+	}
+}
+
+type flakyNotifier struct {
+	fails int
+	got   chan upload
+}
+
+func (n *flakyNotifier) Notify(ctx context.Context, u upload) error {
+	if n.fails > 0 {
+		n.fails--
+		return errors.New("not yet")
+	}
+	n.got <- u
+	return nil
+}
+
+func TestSinkQueueRetries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n := &flakyNotifier{fails: 1, got: make(chan upload, 1)}
+	q := newSinkQueue("flaky", n, 1, 3, false)
+	go q.run(ctx)
+	q.enqueue(testUpload)
+
+	select {
+	case u := <-n.got:
+		if u.ID != testUpload.ID {
+			t.Errorf("delivered %+v", u)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("notification was never retried")
+	}
+}
+
+// stuckNotifier never gets through.
+type stuckNotifier struct{}
+
+func (stuckNotifier) Notify(ctx context.Context, u upload) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestSinkQueueDrains(t *testing.T) {
+	old := *grace
+	defer func() { *grace = old }()
+	*grace = 50 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, test := range []struct {
+		name string
+		n    notifier
+		want bool
+	}{
+		{"ok", &flakyNotifier{got: make(chan upload, 2)}, true},
+		{"stuck", stuckNotifier{}, false},
+	} {
+		q := newSinkQueue(test.name, test.n, 2, 1, false)
+		acks := make(chan bool, 2)
+		for i := 0; i < 2; i++ {
+			u := testUpload
+			u.ack = func(delivered bool) { acks <- delivered }
+			q.enqueue(u)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			q.run(ctx)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v: queue never finished draining", test.name)
+		}
+		for i := 0; i < 2; i++ {
+			if got := <-acks; got != test.want {
+				t.Errorf("%v: delivered = %v, want %v", test.name, got, test.want)
+			}
+		}
+	}
+}
+
+func TestPendingAnnouncements(t *testing.T) {
+	all := newSinkQueue("all", nil, 2, 1, true)
+	done := newSinkQueue("done", nil, 2, 1, false)
+	cam := &camera{ID: "porch", Prefix: "porch", sinks: []*sinkQueue{all, done}}
+	c := clip{ts: time.Date(2017, 5, 18, 10, 24, 0, 0, time.UTC)}
+
+	cam.notify(cam.announcement(c, statusPending, 0, false), nil)
+	cam.notify(cam.announcement(c, statusComplete, 12*time.Second, true), nil)
+
+	if len(all.ch) != 2 || len(done.ch) != 1 {
+		t.Fatalf("queued %v for all, %v for done", len(all.ch), len(done.ch))
+	}
+	p := <-all.ch
+	if p.Status != statusPending || p.Objects["mp4"] != "" || p.Duration != "" {
+		t.Errorf("pending announcement = %+v", p)
+	}
+	u := <-done.ch
+	if u.Status != statusComplete || u.Objects["mp4"] != "porch/20170518102400.mp4" ||
+		u.Objects["avi"] == "" || u.Duration != "12s" {
+		t.Errorf("complete announcement = %+v", u)
+	}
+}
+
+func TestAnnouncedOnceDelivered(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "motion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := *cleanupFlag
+	defer func() { *cleanupFlag = old }()
+	*cleanupFlag = true
+
+	good := &flakyNotifier{got: make(chan upload, 10)}
+	flaky := &flakyNotifier{fails: 1, got: make(chan upload, 10)}
+	cam := &camera{ID: "porch", Dir: dir, sinks: []*sinkQueue{
+		newSinkQueue("good", good, 10, 1, false),
+		newSinkQueue("flaky", flaky, 10, 1, false),
+	}}
+	cam.jrnl, err = openJournal(filepath.Join(dir, ".uploader.journal"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var c clip
+	for _, fn := range []string{"12-20170518102400.avi", "12-20170518102400-00.jpg", "12.details"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, fn), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(filepath.Join(dir, fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch filepath.Ext(fn) {
+		case ".avi":
+			c.ovid = fi
+		case ".jpg":
+			c.thumb = fi
+		default:
+			c.df = fi
+		}
+	}
+	c.ts = time.Date(2017, 5, 18, 10, 24, 0, 0, time.UTC)
+	cam.jrnl.record(c.key(), func(s *clipState) {
+		s.Uploaded["jpg"], s.Uploaded["mp4"], s.Uploaded["avi"] = true, true, true
+	})
+
+	pass := func() {
+		t.Helper()
+		// Announcements still on their way aren't queued again.
+		for i := 0; i < 2; i++ {
+			if err := cam.uploadClip(ctx, c); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, q := range cam.sinks {
+			if len(q.ch) != 1 {
+				t.Fatalf("%v has %v queued, want 1", q.name, len(q.ch))
+			}
+			go q.run(ctx)
+		}
+		drainNotifiers([]*camera{cam})
+	}
+
+	// One sink didn't get it, so it's still to be announced, and the
+	// clip's still here.
+	pass()
+	if cam.jrnl.state(c.key()).Notified {
+		t.Errorf("clip was marked notified when a sink never got it")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "12.details")); err != nil {
+		t.Errorf("clip was cleaned up before it was announced: %v", err)
+	}
+
+	cancel()
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	pass()
+	if st := cam.jrnl.state(c.key()); !st.Notified || !st.Cleaned {
+		t.Errorf("after every sink got it, state = %+v", st)
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, "12*")); len(left) != 0 {
+		t.Errorf("files left behind: %v", left)
+	}
+	if len(good.got) != 2 || len(flaky.got) != 1 {
+		t.Errorf("good got %v, flaky got %v; want 2 and 1", len(good.got), len(flaky.got))
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dustin/reye/logging"
+	"github.com/dustin/reye/vidtool"
+)
+
+var (
+	orphanGrace   = flag.Duration("orphan_grace", 30*time.Minute, "how long to wait for the rest of an incomplete clip before salvaging or quarantining it (0 waits forever)")
+	quarantineDir = flag.String("quarantine", "", "where to move clips that can't be salvaged (default .quarantine in the clip directory); they're removed after -delete_days")
+)
+
+// files returns whichever of the clip's files are present.
+func (c clip) files() []os.FileInfo {
+	var rv []os.FileInfo
+	for _, fi := range []os.FileInfo{c.ovid, c.thumb, c.df} {
+		if fi != nil {
+			rv = append(rv, fi)
+		}
+	}
+	return rv
+}
+
+// missing describes which of the clip's files aren't present.
+func (c clip) missing() []string {
+	var rv []string
+	if c.ovid == nil {
+		rv = append(rv, "video")
+	}
+	if c.thumb == nil {
+		rv = append(rv, "thumbnail")
+	}
+	if c.df == nil {
+		rv = append(rv, "details")
+	}
+	return rv
+}
+
+func (c clip) lastModified() time.Time {
+	var rv time.Time
+	for _, fi := range c.files() {
+		if fi.ModTime().After(rv) {
+			rv = fi.ModTime()
+		}
+	}
+	return rv
+}
+
+// orphaned reports whether an incomplete clip has waited long enough
+// for its missing files.
+func (c clip) orphaned() bool {
+	return !c.complete() && *orphanGrace > 0 && time.Since(c.lastModified()) > *orphanGrace
+}
+
+func (cam *camera) quarantinePath() string {
+	if *quarantineDir == "" {
+		return cam.fq(".quarantine")
+	}
+	if *configFile != "" {
+		return filepath.Join(*quarantineDir, cam.ID)
+	}
+	return *quarantineDir
+}
+
+// pruneQuarantine removes clips that have been in quarantine for longer
+// than maxAge.
+func (cam *camera) pruneQuarantine(maxAge time.Duration) error {
+	dents, err := ioutil.ReadDir(cam.quarantinePath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, dent := range dents {
+		dir := filepath.Join(cam.quarantinePath(), dent.Name())
+		if !dent.IsDir() || time.Since(dent.ModTime()) <= maxAge {
+			continue
+		}
+		// Only touch what quarantine put there.
+		if _, err := os.Stat(filepath.Join(dir, "quarantine.json")); err != nil {
+			continue
+		}
+		slog.Info("removing quarantined clip", logging.Camera, cam.ID, logging.Phase, "retention",
+			"dir", dir, "quarantined", dent.ModTime())
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// toolMissing reports whether err means we couldn't run ffmpeg at all,
+// rather than that it didn't like the clip.
+func toolMissing(ctx context.Context, err error) bool {
+	return ctx.Err() != nil || errors.Is(err, exec.ErrNotFound)
+}
+
+// salvage fills in what it can of an orphaned clip: a thumbnail made
+// from the video, and a details file recording what was missing.
+// Clips without a usable video are quarantined, leaving an empty clip.
+func (cam *camera) salvage(ctx context.Context, id int, c clip) (clip, error) {
+	missing := c.missing()
+	if c.ovid == nil {
+		return clip{}, cam.quarantine(id, c, missing, "no video")
+	}
+	if _, err := vidtool.ClipDuration(ctx, cam.fq(c.ovid.Name())); err != nil {
+		if toolMissing(ctx, err) {
+			return c, err
+		}
+		return clip{}, cam.quarantine(id, c, missing, fmt.Sprintf("unreadable video: %v", err))
+	}
+
+	if c.thumb == nil {
+		tn := strings.TrimSuffix(c.ovid.Name(), filepath.Ext(c.ovid.Name())) + "-salvaged.jpg"
+		if err := vidtool.Thumbnail(ctx, cam.fq(c.ovid.Name()), cam.fq(tn)); err != nil {
+			if toolMissing(ctx, err) {
+				return c, err
+			}
+			return clip{}, cam.quarantine(id, c, missing, fmt.Sprintf("can't make a thumbnail: %v", err))
+		}
+	}
+
+	dn, err := cam.detailsName(id, c)
+	if err != nil {
+		return clip{}, cam.quarantine(id, c, missing, err.Error())
+	}
+	// Motion's details are whitespace separated, so this either adds
+	// to them or stands in for them.
+	f, err := os.OpenFile(cam.fq(dn), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return c, err
+	}
+	fmt.Fprintf(f, "\nmissing=%v\n", strings.Join(missing, ","))
+	if err := f.Close(); err != nil {
+		return c, err
+	}
+
+	logging.From(ctx).Info("salvaged", logging.Camera, cam.ID, logging.Phase, "salvage", "event", id,
+		"missing", strings.Join(missing, ","))
+	clipsSalvaged.WithLabelValues(cam.ID).Inc()
+	return cam.findClip(id)
+}
+
+// detailsName is the name of the clip's details file: the one it has,
+// or a new one named by the camera's details_filename.
+func (cam *camera) detailsName(id int, c clip) (string, error) {
+	if c.df != nil {
+		return c.df.Name(), nil
+	}
+	base, err := cam.naming().details.format(nameInfo{Event: id, Time: c.ts, Frame: c.frame})
+	if err != nil {
+		return "", fmt.Errorf("can't name a details file: %v", err)
+	}
+	if got, ok := cam.clipID(base + ".details"); !ok || got != id {
+		return "", fmt.Errorf("can't name a details file: %v.details isn't event %v", base, id)
+	}
+	return base + ".details", nil
+}
+
+// quarantine moves what there is of a clip into its own directory under
+// the quarantine path, along with a note of what was wrong with it.
+func (cam *camera) quarantine(id int, c clip, missing []string, reason string) error {
+	dir := filepath.Join(cam.quarantinePath(), fmt.Sprintf("%d-%s", id, time.Now().Format(clipTimeFmt)))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	note := struct {
+		Camera      string    `json:"camera"`
+		Event       int       `json:"event"`
+		Files       []string  `json:"files"`
+		Missing     []string  `json:"missing,omitempty"`
+		Reason      string    `json:"reason"`
+		Quarantined time.Time `json:"quarantined"`
+	}{Camera: cam.ID, Event: id, Missing: missing, Reason: reason, Quarantined: time.Now()}
+	for _, fi := range c.files() {
+		note.Files = append(note.Files, fi.Name())
+	}
+	b, err := json.MarshalIndent(note, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "quarantine.json"), b, 0644); err != nil {
+		return err
+	}
+
+	for _, fi := range c.files() {
+		if err := os.Rename(cam.fq(fi.Name()), filepath.Join(dir, fi.Name())); err != nil {
+			return err
+		}
+	}
+	slog.Warn("quarantined", logging.Camera, cam.ID, logging.Phase, "salvage", "event", id,
+		"dir", dir, "reason", reason)
+	clipsQuarantined.WithLabelValues(cam.ID).Inc()
+	return nil
+}
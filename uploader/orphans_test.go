@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQuarantineWithoutVideo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "motion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := time.Now().Add(-2 * *orphanGrace)
+	for _, fn := range []string{"12-20170518102400-00.jpg", "12.details"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, fn), []byte("event=12"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filepath.Join(dir, fn), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cam := &camera{ID: "test", Dir: dir}
+	if err := cam.uploadClips(context.Background()); err != nil {
+		t.Fatalf("uploadClips: %v", err)
+	}
+
+	if left, _ := filepath.Glob(filepath.Join(dir, "12*")); len(left) != 0 {
+		t.Errorf("files left behind: %v", left)
+	}
+	notes, _ := filepath.Glob(filepath.Join(dir, ".quarantine", "12-*", "quarantine.json"))
+	if len(notes) != 1 {
+		t.Fatalf("quarantine notes: %v", notes)
+	}
+	b, err := ioutil.ReadFile(notes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var note struct {
+		Files, Missing []string
+	}
+	if err := json.Unmarshal(b, &note); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(note.Missing, []string{"video"}) || len(note.Files) != 2 {
+		t.Errorf("quarantine note = %s", b)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(notes[0]), "12.details")); err != nil {
+		t.Errorf("details weren't moved to quarantine: %v", err)
+	}
+}
+
+func TestOrphaned(t *testing.T) {
+	d, err := ioutil.TempDir("", "motion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	fn := filepath.Join(d, "12-20170518102400.avi")
+	if err := ioutil.WriteFile(fn, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	st, err := os.Stat(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := (clip{ovid: st}); c.orphaned() {
+		t.Errorf("brand new clip is orphaned")
+	}
+	old := time.Now().Add(-2 * *orphanGrace)
+	os.Chtimes(fn, old, old)
+	if st, err = os.Stat(fn); err != nil {
+		t.Fatal(err)
+	}
+	if c := (clip{ovid: st}); !c.orphaned() {
+		t.Errorf("old incomplete clip isn't orphaned")
+	}
+	if c := (clip{ovid: st, thumb: st, df: st, details: map[string]string{}}); c.orphaned() {
+		t.Errorf("complete clip is orphaned")
+	}
+}
+
+func TestSalvageDetailsName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "motion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	probe := filepath.Join(dir, ".ffprobe")
+	if err := ioutil.WriteFile(probe, []byte("#!/bin/sh\necho '{\"format\": {\"duration\": \"10.0\"}}'\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	old := flag.Lookup("ffprobe").Value.String()
+	defer flag.Set("ffprobe", old)
+	flag.Set("ffprobe", probe)
+
+	for _, test := range []struct {
+		pattern, want string
+	}{
+		{"%v", "26.details"},
+		{"event-%v-%Y%m%d", "event-26-20170518.details"},
+		{"regexp:event-(?P<event>\\d+)", ""},
+	} {
+		for _, fn := range []string{"26-20170518102400.avi", "26-20170518102400-00.jpg"} {
+			if err := ioutil.WriteFile(filepath.Join(dir, fn), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cam := &camera{ID: "test", Dir: dir, DetailsFilename: test.pattern, Timezone: "UTC"}
+		cam.applyDefaults()
+		if err := cam.compileNaming(); err != nil {
+			t.Fatal(err)
+		}
+		c, err := cam.findClip(26)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err = cam.salvage(context.Background(), 26, c)
+		if err != nil {
+			t.Fatalf("%v: salvage: %v", test.pattern, err)
+		}
+
+		if test.want == "" {
+			if c.ovid != nil {
+				t.Errorf("%v: clip without a nameable details file wasn't quarantined", test.pattern)
+			}
+			continue
+		}
+		if c.df == nil || c.df.Name() != test.want || c.details["missing"] != "details" {
+			t.Errorf("%v: salvaged clip = %+v, want details in %v", test.pattern, c, test.want)
+		}
+		os.Remove(filepath.Join(dir, test.want))
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/httputil"
+	"github.com/dustin/reye/sign"
+)
+
+var (
+	pauseURL    = flag.String("pause_url", "", "URL of the app's /api/pause to learn which cameras are paused (signed with -triggerAuth)")
+	pauseEvery  = flag.Duration("pause_interval", time.Minute, "how often to check whether cameras are paused")
+	pausePolicy = flag.String("pause_policy", "hold", "what to do with clips and snapshots while paused: hold (upload them later) or discard")
+)
+
+// Pause policies.
+const (
+	pauseHold    = "hold"
+	pauseDiscard = "discard"
+)
+
+// pauseDoc is how the app describes a camera's pause state.  The
+// schedule is a comma separated list of windows (e.g.
+// 22:00-07:00,12:00-13:00) in the app's timezone, or the camera's if
+// the app doesn't say.
+type pauseDoc struct {
+	Paused   bool   `json:"paused"`
+	Schedule string `json:"schedule,omitempty"`
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// A pausePeriod is when a camera was paused by hand.  End is zero
+// while it's still paused.
+type pausePeriod struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+func (p pausePeriod) contains(t time.Time) bool {
+	return !t.Before(p.Start) && (p.End.IsZero() || t.Before(p.End))
+}
+
+// pauseCache is what's kept in the camera's .pause file.
+type pauseCache struct {
+	pauseDoc
+	Periods []pausePeriod `json:"periods,omitempty"`
+}
+
+// pauseState is the last pause state we heard for a camera, along with
+// when it was paused and resumed by hand, so clips can be judged by
+// when they were captured.  It's cached in the camera's directory so a
+// restart while the app can't be reached doesn't start publishing
+// again.
+type pauseState struct {
+	mu       sync.Mutex
+	doc      pauseDoc
+	periods  []pausePeriod
+	schedule []window
+	loc      *time.Location // of the schedule
+	loaded   bool
+}
+
+// pauseSchedule parses a pauseDoc's schedule and the timezone it's in.
+func (cam *camera) pauseSchedule(doc pauseDoc) ([]window, *time.Location, error) {
+	loc := cam.naming().loc
+	if doc.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(doc.Timezone); err != nil {
+			return nil, nil, err
+		}
+	}
+	ws, err := parseSchedule(doc.Schedule)
+	return ws, loc, err
+}
+
+func parseSchedule(s string) ([]window, error) {
+	var rv []window
+	for _, ws := range strings.Split(s, ",") {
+		if strings.TrimSpace(ws) == "" {
+			continue
+		}
+		w, err := parseWindow(strings.TrimSpace(ws))
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, w)
+	}
+	return rv, nil
+}
+
+func checkPausePolicy(p string) error {
+	if p != pauseHold && p != pauseDiscard {
+		return fmt.Errorf("invalid pause policy %q, want %v or %v", p, pauseHold, pauseDiscard)
+	}
+	return nil
+}
+
+func (cam *camera) pauseFile() string {
+	return cam.fq(".pause")
+}
+
+// loadPause reads the cached pause state, if there is one.
+func (cam *camera) loadPause() error {
+	cam.pause.mu.Lock()
+	defer cam.pause.mu.Unlock()
+	if cam.pause.loaded {
+		return nil
+	}
+	cam.pause.loaded = true
+
+	b, err := ioutil.ReadFile(cam.pauseFile())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var pc pauseCache
+	if err := json.Unmarshal(b, &pc); err != nil {
+		return fmt.Errorf("parsing %v: %v", cam.pauseFile(), err)
+	}
+	sched, loc, err := cam.pauseSchedule(pc.pauseDoc)
+	if err != nil {
+		return err
+	}
+	if pc.Paused && (len(pc.Periods) == 0 || !pc.Periods[len(pc.Periods)-1].End.IsZero()) {
+		// We don't know when it was paused, so assume always.
+		pc.Periods = append(pc.Periods, pausePeriod{})
+	}
+	cam.pause.doc, cam.pause.periods = pc.pauseDoc, pc.Periods
+	cam.pause.schedule, cam.pause.loc = sched, loc
+	return nil
+}
+
+// setPause applies (and caches) a pause state from the app, heard at
+// now.
+func (cam *camera) setPause(doc pauseDoc, now time.Time) error {
+	sched, loc, err := cam.pauseSchedule(doc)
+	if err != nil {
+		return err
+	}
+	// The cached periods are added to, rather than forgotten.
+	if err := cam.loadPause(); err != nil {
+		log.Printf("%v: can't load pause state: %v", cam.ID, err)
+	}
+
+	cam.pause.mu.Lock()
+	defer cam.pause.mu.Unlock()
+	if cam.pause.doc == doc {
+		return nil
+	}
+	if cam.pause.doc.Paused != doc.Paused {
+		if doc.Paused {
+			log.Printf("%v: paused, will %v clips and snapshots", cam.ID, cam.PausePolicy)
+			cam.pause.periods = append(cam.pause.periods, pausePeriod{Start: now})
+		} else {
+			log.Printf("%v: resumed", cam.ID)
+			if n := len(cam.pause.periods); n > 0 {
+				cam.pause.periods[n-1].End = now
+			}
+		}
+	}
+	if cam.pause.doc.Schedule != doc.Schedule {
+		log.Printf("%v: pause schedule is now %q", cam.ID, doc.Schedule)
+	}
+	cam.pause.doc, cam.pause.schedule, cam.pause.loc = doc, sched, loc
+
+	// Periods are only interesting while there might be clips from them.
+	cutoff := now.Add(-cam.journalAge())
+	var periods []pausePeriod
+	for _, p := range cam.pause.periods {
+		if p.End.IsZero() || p.End.After(cutoff) {
+			periods = append(periods, p)
+		}
+	}
+	cam.pause.periods = periods
+
+	b, err := json.Marshal(pauseCache{doc, periods})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cam.pauseFile(), b, 0644)
+}
+
+// paused reports whether the camera was (or is) paused at t.
+func (cam *camera) paused(t time.Time) bool {
+	if err := cam.loadPause(); err != nil {
+		log.Printf("%v: can't load pause state: %v", cam.ID, err)
+	}
+	cam.pause.mu.Lock()
+	defer cam.pause.mu.Unlock()
+	for _, p := range cam.pause.periods {
+		if p.contains(t) {
+			return true
+		}
+	}
+	if len(cam.pause.schedule) == 0 {
+		return false
+	}
+	lt := t.In(cam.pause.loc)
+	for _, w := range cam.pause.schedule {
+		if w.contains(lt) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchPauses asks the app for every camera's pause state in one signed
+// request.
+func fetchPauses(ctx context.Context, u string, k sign.Key, cams []*camera) error {
+	var ids []string
+	for _, cam := range cams {
+		ids = append(ids, cam.appID())
+	}
+	body, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "application/json")
+	if err := sign.Sign(req, body, k, time.Now()); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, *notifyTimeout)
+	defer cancel()
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return httputil.HTTPError(res)
+	}
+
+	docs := map[string]pauseDoc{}
+	if err := json.NewDecoder(res.Body).Decode(&docs); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, cam := range cams {
+		// Cameras the app doesn't know about aren't paused.
+		if err := cam.setPause(docs[cam.appID()], now); err != nil {
+			log.Printf("%v: invalid pause state %+v: %v", cam.ID, docs[cam.appID()], err)
+		}
+	}
+	return nil
+}
+
+// startPauses learns whether the cameras are paused before anything's
+// uploaded, then checks again every -pause_interval until we start
+// shutting down.  When the app can't be reached, the last state we
+// heard stands.
+func startPauses(ctx context.Context, cams []*camera) error {
+	if *pauseURL == "" {
+		return nil
+	}
+	k, err := sign.ParseKey(*triggerAuth)
+	if err != nil {
+		return fmt.Errorf("-triggerAuth: %v", err)
+	}
+	if err := fetchPauses(ctx, *pauseURL, k, cams); err != nil {
+		log.Printf("Error checking whether cameras are paused: %v", err)
+	}
+	go func() {
+		t := time.NewTicker(*pauseEvery)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+			case <-work.stopping:
+				return
+			}
+			if err := fetchPauses(ctx, *pauseURL, k, cams); err != nil {
+				log.Printf("Error checking whether cameras are paused: %v", err)
+			}
+		}
+	}()
+	return nil
+}
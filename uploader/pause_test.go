@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dustin/reye/sign"
+)
+
+func TestFetchPauses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "motion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := sign.Key{ID: "k1", Secret: []byte("sekrit")}
+	v := &sign.Verifier{Keys: []sign.Key{key}, MaxSkew: time.Minute}
+	docs := map[string]pauseDoc{
+		"porch": {Paused: true},
+		"yard":  {Schedule: "22:00-07:00"},
+	}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := v.Verify(r, body, time.Now()); err != nil {
+			http.Error(w, err.Error(), 401)
+			return
+		}
+		var ids []string
+		if err := json.Unmarshal(body, &ids); err != nil || len(ids) != 3 {
+			http.Error(w, "bad camera list", 400)
+			return
+		}
+		json.NewEncoder(w).Encode(docs)
+	}))
+	defer s.Close()
+
+	mkcam := func(id string) *camera {
+		cam := &camera{ID: id, Dir: filepath.Join(dir, id)}
+		if err := os.Mkdir(cam.Dir, 0755); err != nil && !os.IsExist(err) {
+			t.Fatal(err)
+		}
+		return cam
+	}
+	porch, yard, basement := mkcam("porch"), mkcam("yard"), mkcam("basement")
+	if err := fetchPauses(context.Background(), s.URL, key, []*camera{porch, yard, basement}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tomorrow, as porch was paused just now.
+	y, m, d := time.Now().AddDate(0, 0, 1).Date()
+	night := time.Date(y, m, d, 23, 0, 0, 0, time.Local)
+	noon := time.Date(y, m, d, 12, 0, 0, 0, time.Local)
+	for _, test := range []struct {
+		cam    *camera
+		t      time.Time
+		paused bool
+	}{
+		{porch, noon, true},
+		{yard, noon, false},
+		{yard, night, true},
+		{basement, night, false},
+	} {
+		if got := test.cam.paused(test.t); got != test.paused {
+			t.Errorf("%v paused at %v = %v, want %v", test.cam.ID, test.t, got, test.paused)
+		}
+	}
+
+	// The last state we heard survives a restart.
+	if !mkcam("porch").paused(noon) {
+		t.Errorf("porch isn't paused after a restart")
+	}
+
+	docs["porch"] = pauseDoc{}
+	if err := fetchPauses(context.Background(), s.URL, key, []*camera{porch, yard, basement}); err != nil {
+		t.Fatal(err)
+	}
+	if porch.paused(noon) || mkcam("porch").paused(noon) {
+		t.Errorf("porch is still paused after it's resumed")
+	}
+
+	key.Secret = []byte("wrong")
+	if err := fetchPauses(context.Background(), s.URL, key, []*camera{porch}); err == nil {
+		t.Errorf("a badly signed request worked")
+	}
+}
+
+func TestPausePolicies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "motion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, policy := range []string{pauseHold, pauseDiscard} {
+		cam := &camera{ID: policy, Dir: dir, PausePolicy: policy}
+		cam.jrnl, err = openJournal(filepath.Join(dir, policy+".journal"), time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := clip{ts: time.Date(2017, 5, 18, 10, 24, 0, 0, time.Local)}
+		if err := cam.setPause(pauseDoc{Paused: true}, c.ts.Add(-time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := cam.uploadClip(context.Background(), c); err != nil {
+			t.Fatalf("%v: uploadClip: %v", policy, err)
+		}
+		want, outcome := "", "paused"
+		if policy == pauseDiscard {
+			want, outcome = "paused", "discarded"
+		}
+		if got := cam.jrnl.state(c.key()).Filtered; got != want {
+			t.Errorf("%v: clip filtered = %q, want %q", policy, got, want)
+		}
+		if !strings.Contains(cam.summary(), "1 "+outcome) {
+			t.Errorf("%v: summary = %v, want 1 %v", policy, cam.summary(), outcome)
+		}
+	}
+
+	if err := checkPausePolicy("sometimes"); err == nil {
+		t.Errorf("an invalid pause policy was accepted")
+	}
+}
+
+func TestPausedByCaptureTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "motion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	at := func(h, m int) time.Time { return time.Date(2017, 5, 18, h, m, 0, 0, time.Local) }
+	cam := &camera{ID: "test", Dir: dir, PausePolicy: pauseDiscard, DeleteDays: 7}
+	cam.jrnl, err = openJournal(filepath.Join(dir, ".journal"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cam.setPause(pauseDoc{Paused: true}, at(10, 30)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cam.setPause(pauseDoc{}, at(11, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []*camera{cam, {ID: "restarted", Dir: dir}} {
+		for _, test := range []struct {
+			t      time.Time
+			paused bool
+		}{
+			{at(10, 15), false},
+			{at(10, 30), true},
+			{at(10, 45), true},
+			{at(11, 0), false},
+		} {
+			if got := c.paused(test.t); got != test.paused {
+				t.Errorf("%v: paused at %v = %v, want %v", c.ID, test.t, got, test.paused)
+			}
+		}
+	}
+
+	// A clip captured while paused is discarded after the camera's
+	// resumed.
+	during := clip{ts: at(10, 45)}
+	if err := cam.uploadClip(context.Background(), during); err != nil {
+		t.Fatal(err)
+	}
+	if got := cam.jrnl.state(during.key()).Filtered; got != "paused" {
+		t.Errorf("clip captured while paused was filtered %q, want it discarded", got)
+	}
+
+	// One captured before the camera was paused again is only held.
+	if err := cam.setPause(pauseDoc{Paused: true}, at(12, 0)); err != nil {
+		t.Fatal(err)
+	}
+	before := clip{ts: at(11, 30)}
+	if err := cam.uploadClip(context.Background(), before); err != nil {
+		t.Fatal(err)
+	}
+	if got := cam.jrnl.state(before.key()).Filtered; got != "" {
+		t.Errorf("clip captured before the pause was filtered %q, want it held", got)
+	}
+	if !strings.Contains(cam.summary(), "1 paused") || !strings.Contains(cam.summary(), "1 discarded") {
+		t.Errorf("summary = %v", cam.summary())
+	}
+
+	// Caches from before we kept periods were paused for as long as we know.
+	if err := ioutil.WriteFile(filepath.Join(dir, ".pause"), []byte(`{"paused": true}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if old := (&camera{ID: "old", Dir: dir}); !old.paused(at(0, 0)) {
+		t.Errorf("an old paused cache isn't paused")
+	}
+}
+
+func TestPauseScheduleTimezone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "motion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skip(err)
+	}
+	cam := &camera{ID: "test", Dir: dir, Timezone: "UTC"}
+	if err := cam.setPause(pauseDoc{Schedule: "22:00-23:00", Timezone: "Asia/Tokyo"}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	// The schedule's in the app's timezone, not the camera's.
+	if !cam.paused(time.Date(2017, 5, 18, 22, 30, 0, 0, tokyo)) {
+		t.Errorf("not paused during the schedule in the app's timezone")
+	}
+	if cam.paused(time.Date(2017, 5, 18, 22, 30, 0, 0, time.UTC)) {
+		t.Errorf("paused during the schedule in the camera's timezone")
+	}
+	if !(&camera{ID: "restarted", Dir: dir}).paused(time.Date(2017, 5, 18, 22, 30, 0, 0, tokyo)) {
+		t.Errorf("the schedule's timezone was lost in a restart")
+	}
+
+	if err := cam.setPause(pauseDoc{Schedule: "22:00-23:00", Timezone: "Nowhere/Special"}, time.Now()); err == nil {
+		t.Errorf("a schedule in an unknown timezone was accepted")
+	}
+}
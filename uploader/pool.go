@@ -0,0 +1,159 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"flag"
+	"fmt"
+	"sync"
+)
+
+var (
+	clipWorkers = flag.Int("clip_workers", 4, "how many clips to work on at once across all cameras")
+	uploaders   = flag.Int("uploaders", 4, "maximum number of concurrent clip object uploads")
+)
+
+// checkPoolFlags makes sure there's someone to do the work; with no
+// workers or upload slots, clips would wait forever.
+func checkPoolFlags() error {
+	if *clipWorkers < 1 {
+		return fmt.Errorf("-clip_workers must be at least 1, not %v", *clipWorkers)
+	}
+	if *uploaders < 1 {
+		return fmt.Errorf("-uploaders must be at least 1, not %v", *uploaders)
+	}
+	return nil
+}
+
+// A clipJob is a clip waiting for a worker, along with everyone
+// waiting to hear how it went.
+type clipJob struct {
+	ctx     context.Context
+	cam     *camera
+	c       clip
+	key     string
+	waiters []chan error
+}
+
+// jobHeap orders jobs newest clip first.
+type jobHeap []*clipJob
+
+func (h jobHeap) Len() int { return len(h) }
+func (h jobHeap) Less(i, j int) bool {
+	if !h[i].c.ts.Equal(h[j].c.ts) {
+		return h[i].c.ts.After(h[j].c.ts)
+	}
+	return h[i].key < h[j].key
+}
+func (h jobHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *jobHeap) Push(x interface{}) { *h = append(*h, x.(*clipJob)) }
+func (h *jobHeap) Pop() interface{} {
+	old := *h
+	j := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return j
+}
+
+// A clipQueue feeds clips from every camera (and the scans, watchers
+// and hooks of each) to a fixed set of workers, newest first.  A clip
+// that's already queued or being worked on isn't queued again; its
+// submitters all get the one result.
+type clipQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	jobs    jobHeap
+	queued  map[string]*clipJob
+	start   sync.Once
+	workers int
+	run     func(*camera, context.Context, clip) error
+}
+
+func newClipQueue(workers int, run func(*camera, context.Context, clip) error) *clipQueue {
+	q := &clipQueue{queued: map[string]*clipJob{}, workers: workers, run: run}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+var clipWork = newClipQueue(0, (*camera).uploadClip)
+
+// submit queues a clip for upload, returning a channel that receives
+// the result.
+func (q *clipQueue) submit(ctx context.Context, cam *camera, c clip) <-chan error {
+	q.start.Do(func() {
+		if q.workers == 0 {
+			q.workers = *clipWorkers
+		}
+		for i := 0; i < q.workers; i++ {
+			go q.work()
+		}
+	})
+
+	ch := make(chan error, 1)
+	key := cam.fq(c.ovid.Name())
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if j, ok := q.queued[key]; ok {
+		j.waiters = append(j.waiters, ch)
+		return ch
+	}
+	j := &clipJob{ctx: ctx, cam: cam, c: c, key: key, waiters: []chan error{ch}}
+	q.queued[key] = j
+	heap.Push(&q.jobs, j)
+	q.cond.Signal()
+	return ch
+}
+
+// pending is how many of cam's clips are queued or being worked on.
+func (q *clipQueue) pending(cam *camera) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for _, j := range q.queued {
+		if j.cam == cam {
+			n++
+		}
+	}
+	return n
+}
+
+func (q *clipQueue) work() {
+	for {
+		q.mu.Lock()
+		for len(q.jobs) == 0 {
+			q.cond.Wait()
+		}
+		j := heap.Pop(&q.jobs).(*clipJob)
+		q.mu.Unlock()
+
+		err := q.run(j.cam, j.ctx, j.c)
+
+		q.mu.Lock()
+		delete(q.queued, j.key)
+		for _, ch := range j.waiters {
+			ch <- err
+		}
+		q.mu.Unlock()
+	}
+}
+
+// uploadSlots limits clip object uploads across all cameras.  Snapshots
+// don't take a slot so a backlog can't make them late.
+var uploadSlots struct {
+	once sync.Once
+	ch   chan bool
+}
+
+func acquireUpload(ctx context.Context) error {
+	uploadSlots.once.Do(func() { uploadSlots.ch = make(chan bool, *uploaders) })
+	select {
+	case uploadSlots.ch <- true:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func releaseUpload() {
+	<-uploadSlots.ch
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClipQueueNewestFirst(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	release := make(chan bool)
+	q := newClipQueue(1, func(cam *camera, ctx context.Context, c clip) error {
+		if c.ovid.Name() == "blocker.avi" {
+			<-release
+		}
+		mu.Lock()
+		order = append(order, c.ovid.Name())
+		mu.Unlock()
+		return nil
+	})
+
+	cam := &camera{ID: "test", Dir: "/tmp"}
+	at := func(name string, minutes int) clip {
+		return clip{ovid: fakeFile(name), ts: time.Date(2017, 5, 18, 10, minutes, 0, 0, time.UTC)}
+	}
+	ctx := context.Background()
+
+	// Keep the only worker busy while the rest queue up.
+	first := q.submit(ctx, cam, at("blocker.avi", 0))
+	for {
+		q.mu.Lock()
+		n := len(q.jobs)
+		q.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	results := []<-chan error{
+		q.submit(ctx, cam, at("old.avi", 1)),
+		q.submit(ctx, cam, at("new.avi", 3)),
+		q.submit(ctx, cam, at("middle.avi", 2)),
+		q.submit(ctx, cam, at("new.avi", 3)),
+		q.submit(ctx, cam, at("blocker.avi", 0)),
+	}
+	close(release)
+	for _, ch := range append(results, first) {
+		if err := <-ch; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{"blocker.avi", "new.avi", "middle.avi", "old.avi"}
+	if len(order) != len(want) {
+		t.Fatalf("ran %v, want %v", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("ran %v, want %v", order, want)
+		}
+	}
+}
+
+func TestCheckPoolFlags(t *testing.T) {
+	oldWorkers, oldUploaders := *clipWorkers, *uploaders
+	defer func() { *clipWorkers, *uploaders = oldWorkers, oldUploaders }()
+
+	for _, test := range []struct {
+		workers, uploaders int
+		ok                 bool
+	}{
+		{4, 4, true},
+		{1, 1, true},
+		{0, 4, false},
+		{4, 0, false},
+		{-1, 4, false},
+	} {
+		*clipWorkers, *uploaders = test.workers, test.uploaders
+		if err := checkPoolFlags(); (err == nil) != test.ok {
+			t.Errorf("-clip_workers=%v -uploaders=%v: got %v, want ok=%v",
+				test.workers, test.uploaders, err, test.ok)
+		}
+	}
+}
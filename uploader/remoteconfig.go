@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dustin/httputil"
+	"github.com/dustin/reye/sign"
+)
+
+var (
+	configURL   = flag.String("config_url", "", "URL of the app's /api/config to fetch camera settings from (signed with -triggerAuth)")
+	configEvery = flag.Duration("config_interval", 5*time.Minute, "how often to check the app for new camera settings")
+)
+
+// remoteConfig is the part of a camera's config the app can change.
+// Anything it leaves out (zero) keeps the camera's local setting.
+type remoteConfig struct {
+	Version         int           `json:"version"`
+	DeleteDays      int           `json:"delete_days,omitempty"`
+	TriggerURL      string        `json:"trigger_url,omitempty"`
+	SnapshotTimeout time.Duration `json:"snapshot_timeout,omitempty"`
+}
+
+// remoteState is what we've heard from the app about a camera's config.
+type remoteState struct {
+	mu       sync.Mutex
+	applied  remoteConfig
+	fetched  time.Time
+	fetchErr string
+	trigger  *sinkQueue // for the current TriggerURL
+}
+
+// settings are the camera's current remotely configurable settings:
+// the app's, where it has any, and the local config's otherwise.
+func (cam *camera) settings() remoteConfig {
+	cam.remote.mu.Lock()
+	defer cam.remote.mu.Unlock()
+	rc := cam.remote.applied
+	if rc.DeleteDays == 0 {
+		rc.DeleteDays = cam.DeleteDays
+	}
+	if rc.TriggerURL == "" {
+		rc.TriggerURL = cam.TriggerURL
+	}
+	if rc.SnapshotTimeout == 0 {
+		rc.SnapshotTimeout = cam.SnapshotTimeout
+	}
+	return rc
+}
+
+// applyConfig switches the camera over to a new config from the app.
+func (cam *camera) applyConfig(rc remoteConfig) error {
+	if rc.DeleteDays < 0 || rc.SnapshotTimeout < 0 {
+		return fmt.Errorf("invalid config version %v: %+v", rc.Version, rc)
+	}
+	before := cam.settings()
+
+	cam.remote.mu.Lock()
+	cam.remote.applied = rc
+	cam.remote.mu.Unlock()
+
+	after := cam.settings()
+	if after.DeleteDays != before.DeleteDays {
+		cam.jrnl.setMaxAge(cam.journalAge())
+	}
+	if after.TriggerURL != before.TriggerURL {
+		if err := cam.setTrigger(after.TriggerURL); err != nil {
+			return err
+		}
+	}
+	log.Printf("%v: applied config version %v: delete_days=%v trigger_url=%q snapshot_timeout=%v",
+		cam.ID, after.Version, after.DeleteDays, after.TriggerURL, after.SnapshotTimeout)
+	return nil
+}
+
+func (cam *camera) noteConfigFetch(t time.Time, err error) {
+	cam.remote.mu.Lock()
+	defer cam.remote.mu.Unlock()
+	cam.remote.fetched = t
+	cam.remote.fetchErr = ""
+	if err != nil {
+		cam.remote.fetchErr = err.Error()
+	}
+}
+
+// fetchConfigs asks the app, in one signed request, for the config of
+// any of the cameras whose version has changed, and applies them.
+func fetchConfigs(ctx context.Context, u string, k sign.Key, cams []*camera) error {
+	have := map[string]int{}
+	for _, cam := range cams {
+		have[cam.appID()] = cam.settings().Version
+	}
+	configs, err := requestConfigs(ctx, u, k, have)
+	now := time.Now()
+	for _, cam := range cams {
+		cam.noteConfigFetch(now, err)
+	}
+	if err != nil {
+		return err
+	}
+	for _, cam := range cams {
+		rc, ok := configs[cam.appID()]
+		if !ok || rc.Version == have[cam.appID()] {
+			continue
+		}
+		if err := cam.applyConfig(rc); err != nil {
+			log.Printf("%v: error applying config: %v", cam.ID, err)
+			cam.noteConfigFetch(now, err)
+		}
+	}
+	return nil
+}
+
+func requestConfigs(ctx context.Context, u string, k sign.Key, have map[string]int) (map[string]remoteConfig, error) {
+	body, err := json.Marshal(have)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("content-type", "application/json")
+	if err := sign.Sign(req, body, k, time.Now()); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, *notifyTimeout)
+	defer cancel()
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, httputil.HTTPError(res)
+	}
+	rv := map[string]remoteConfig{}
+	err = json.NewDecoder(res.Body).Decode(&rv)
+	return rv, err
+}
+
+// startRemoteConfig fetches the cameras' config from the app before we
+// do anything with them, then checks for changes every
+// -config_interval until we start shutting down.  When the app can't
+// be reached, the config we have stands.
+func startRemoteConfig(ctx context.Context, cams []*camera) error {
+	if *configURL == "" {
+		return nil
+	}
+	k, err := sign.ParseKey(*triggerAuth)
+	if err != nil {
+		return fmt.Errorf("-triggerAuth: %v", err)
+	}
+	if err := fetchConfigs(ctx, *configURL, k, cams); err != nil {
+		log.Printf("Error fetching camera config: %v", err)
+	}
+	go func() {
+		t := time.NewTicker(*configEvery)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+			case <-work.stopping:
+				return
+			}
+			if err := fetchConfigs(ctx, *configURL, k, cams); err != nil {
+				log.Printf("Error fetching camera config: %v", err)
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dustin/reye/sign"
+)
+
+func TestFetchConfigs(t *testing.T) {
+	key := sign.Key{ID: "k1", Secret: []byte("sekrit")}
+	v := &sign.Verifier{Keys: []sign.Key{key}, MaxSkew: time.Minute}
+	configs := map[string]remoteConfig{
+		"porch": {Version: 2, DeleteDays: 3, SnapshotTimeout: 10 * time.Second},
+	}
+	var asked map[string]int
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := v.Verify(r, body, time.Now()); err != nil {
+			http.Error(w, err.Error(), 401)
+			return
+		}
+		if err := json.Unmarshal(body, &asked); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		rv := map[string]remoteConfig{}
+		for id, have := range asked {
+			if rc, ok := configs[id]; ok && rc.Version != have {
+				rv[id] = rc
+			}
+		}
+		json.NewEncoder(w).Encode(rv)
+	}))
+	defer s.Close()
+
+	porch := &camera{ID: "porch", DeleteDays: 7, TriggerURL: "http://app/api/newfile", SnapshotTimeout: 5 * time.Second}
+	yard := &camera{ID: "yard", DeleteDays: 7, SnapshotTimeout: 5 * time.Second}
+	cams := []*camera{porch, yard}
+	if err := fetchConfigs(context.Background(), s.URL, key, cams); err != nil {
+		t.Fatal(err)
+	}
+	exp := remoteConfig{Version: 2, DeleteDays: 3, TriggerURL: "http://app/api/newfile", SnapshotTimeout: 10 * time.Second}
+	if got := porch.settings(); got != exp {
+		t.Errorf("porch settings = %+v, want %+v", got, exp)
+	}
+	if got := yard.settings(); got.Version != 0 || got.DeleteDays != 7 {
+		t.Errorf("yard settings = %+v, want its local ones", got)
+	}
+
+	// We say which versions we have, so nothing changes.
+	if err := fetchConfigs(context.Background(), s.URL, key, cams); err != nil {
+		t.Fatal(err)
+	}
+	if asked["porch"] != 2 || asked["yard"] != 0 {
+		t.Errorf("asked for %v", asked)
+	}
+
+	st := daemonStatus{Cameras: []camStatus{porch.status(time.Now())}}
+	buf := &bytes.Buffer{}
+	printStatus(buf, st, time.Now())
+	if !strings.Contains(buf.String(), "config version 2 (fetched now)") {
+		t.Errorf("status output is missing the config:\n%v", buf)
+	}
+
+	key.Secret = []byte("wrong")
+	if err := fetchConfigs(context.Background(), s.URL, key, cams); err == nil {
+		t.Errorf("a badly signed request worked")
+	}
+	if st := porch.status(time.Now()); st.ConfigError == "" || st.Config.Version != 2 {
+		t.Errorf("after a failed fetch, status = %+v", st)
+	}
+}
+
+func TestRemoteTrigger(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	old := *triggerAuth
+	defer func() { *triggerAuth = old }()
+	*triggerAuth = "k1:sekrit"
+
+	porch := &camera{ID: "porch", TriggerURL: "http://one/api/newfile"}
+	yard := &camera{ID: "yard", TriggerURL: "http://one/api/newfile"}
+	if err := startNotifiers(ctx, []*camera{porch, yard}); err != nil {
+		t.Fatal(err)
+	}
+	if q := porch.sinkQueues(); len(q) != 1 || q[0] != yard.sinkQueues()[0] {
+		t.Fatalf("cameras with the same trigger don't share it: %v, %v", q, yard.sinkQueues())
+	}
+
+	if err := porch.applyConfig(remoteConfig{Version: 1, TriggerURL: "http://two/api/newfile"}); err != nil {
+		t.Fatal(err)
+	}
+	if q := porch.sinkQueues(); len(q) != 1 || q[0].name != "reye http://two/api/newfile" {
+		t.Errorf("porch's trigger wasn't moved: %v", q)
+	}
+	if q := yard.sinkQueues(); len(q) != 1 || q[0].name != "reye http://one/api/newfile" {
+		t.Errorf("yard's trigger moved, too: %v", q)
+	}
+}
+
+func TestRemoteDeleteDays(t *testing.T) {
+	dir, err := ioutil.TempDir("", "motion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cam := &camera{ID: "test", Dir: dir, DeleteDays: 1}
+	cam.initJournal()
+	cam.jrnl.record("old", func(st *clipState) { st.Discovered = time.Now().Add(-3 * 24 * time.Hour) })
+
+	if err := cam.applyConfig(remoteConfig{Version: 1, DeleteDays: 7}); err != nil {
+		t.Fatal(err)
+	}
+	cam.jrnl.mu.Lock()
+	err = cam.jrnl.compact()
+	cam.jrnl.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cam.jrnl.state("old").Discovered.IsZero() {
+		t.Errorf("the journal forgot a clip within the app's delete_days")
+	}
+
+	if err := cam.applyConfig(remoteConfig{Version: 2, DeleteDays: 1}); err != nil {
+		t.Fatal(err)
+	}
+	cam.jrnl.mu.Lock()
+	err = cam.jrnl.compact()
+	cam.jrnl.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cam.jrnl.state("old").Discovered.IsZero() {
+		t.Errorf("the journal remembers a clip past delete_days")
+	}
+}
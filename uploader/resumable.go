@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/dustin/reye/logging"
+	"github.com/dustin/yellow"
+)
+
+var (
+	resumableMin = flag.Int64("resumable_min", 32<<20, "upload files at least this big in resumable chunks")
+	chunkSize    = flag.Int("chunk_size", 8<<20, "size of each resumable upload chunk (rounded to 256KiB)")
+)
+
+// A resumableStore can upload an object in chunks over a session that
+// outlives the process.
+type resumableStore interface {
+	blobStore
+
+	// StartResumable begins an upload session for an object of the
+	// given size, returning a session identifier worth persisting.
+	StartResumable(ctx context.Context, name string, size int64, attrs objectAttrs) (string, error)
+	// Resume reports how many bytes of the session have been stored.
+	Resume(ctx context.Context, session string, size int64) (int64, error)
+	// PutChunk stores chunk at offset off and returns the new offset.
+	PutChunk(ctx context.Context, session string, chunk []byte, off, size int64) (int64, error)
+}
+
+func uploadChunkSize() int {
+	n := *chunkSize &^ (256<<10 - 1)
+	if n <= 0 {
+		n = 256 << 10
+	}
+	return n
+}
+
+// uploadResumable sends f in chunks, picking up any session the journal
+// remembers for this object.  Each chunk gets its own deadline, so a
+// slow link only fails when it stops making progress.
+func uploadResumable(ctx context.Context, rs resumableStore, jrnl *journal, f *os.File, size int64,
+	key, oname string, attrs objectAttrs) error {
+
+	var off int64
+	session := jrnl.state(key).Sessions[oname]
+	if session != "" {
+		var err error
+		if off, err = rs.Resume(ctx, session, size); err != nil {
+			logging.From(ctx).Warn("can't resume upload, starting over", logging.Phase, "upload",
+				logging.Object, oname, "error", err)
+			session, off = "", 0
+		} else {
+			logging.From(ctx).Info("resuming upload", logging.Phase, "upload", logging.Object, oname,
+				logging.Bytes, off, "size", size)
+		}
+	}
+	if session == "" {
+		var err error
+		if session, err = rs.StartResumable(ctx, oname, size, attrs); err != nil {
+			return err
+		}
+		jrnl.record(key, func(s *clipState) { s.Sessions[oname] = session })
+	}
+
+	buf := make([]byte, uploadChunkSize())
+	for off < size {
+		n, err := f.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n == 0 {
+			// It must have been truncated since we looked at it.
+			return fmt.Errorf("%v ended at %v bytes, expected %v", f.Name(), off, size)
+		}
+
+		if err := throttle(ctx, n); err != nil {
+			return err
+		}
+
+		// Just hang up if we don't get at least 12kBps.
+		deadline := (5 * time.Second) + estimateTime(n, 12000)
+		w := yellow.DeadlineLogWarn(deadline*3/4, "Uploading chunk of %v at %v", oname, off)
+		cctx, cancel := context.WithTimeout(ctx, deadline)
+		prev := off
+		off, err = rs.PutChunk(cctx, session, buf[:n], off, size)
+		cancel()
+		w.Done()
+		if err != nil {
+			// The session stays in the journal for next time.
+			return err
+		}
+		if off <= prev {
+			return fmt.Errorf("upload of %v isn't making progress (stuck at %v of %v bytes)", oname, off, size)
+		}
+
+		logging.From(ctx).Debug("uploaded chunk", logging.Phase, "upload", logging.Object, oname,
+			logging.Bytes, off, "size", size)
+	}
+
+	jrnl.record(key, func(s *clipState) { delete(s.Sessions, oname) })
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+var minFree = flag.String("min_free", "", "delete the oldest uploaded files early to keep this much disk free (e.g. 10% or 2GB)")
+
+// freeTarget is how many bytes we want free on a disk of the given size.
+func freeTarget(spec string, total uint64) (uint64, error) {
+	if spec == "" {
+		return 0, nil
+	}
+	if strings.HasSuffix(spec, "%") {
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(spec, "%"), 64)
+		if err != nil || pct < 0 || pct > 100 {
+			return 0, fmt.Errorf("invalid percentage %q", spec)
+		}
+		return uint64(float64(total) * pct / 100), nil
+	}
+	return humanize.ParseBytes(spec)
+}
+
+// finished reports whether every object for the given clip is stored,
+// or the clip was filtered out.
+func (cam *camera) finished(key string) bool {
+	return cam.jrnl.state(key).finished()
+}
+
+// A fileGroup is what retention removes at once: all of a clip's
+// files, or any other single file.
+type fileGroup struct {
+	files    []os.FileInfo
+	modified time.Time // of the newest file
+	size     uint64
+}
+
+func (g *fileGroup) add(fi os.FileInfo) {
+	g.files = append(g.files, fi)
+	if fi.ModTime().After(g.modified) {
+		g.modified = fi.ModTime()
+	}
+	g.size += uint64(fi.Size())
+}
+
+// removeOldFiles applies the retention policy to the camera's directory.
+// Files belonging to clips that haven't been completely uploaded are
+// never removed.  Everything else goes once it's older than DeleteDays,
+// and the oldest of it goes early if the disk is running out of space.
+// Quarantined clips go once they've been in quarantine for DeleteDays,
+// but never early: they were never uploaded.
+func (cam *camera) removeOldFiles(ctx context.Context) error {
+	d, err := os.Open(cam.Dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	dents, err := d.Readdir(-1)
+	if err != nil {
+		return err
+	}
+
+	// The .avi tells us which clip (and journal entry) an id is.
+	keys := map[int]string{}
+	for _, dent := range dents {
+		if strings.HasSuffix(dent.Name(), ".avi") {
+			if info, err := cam.parseClipInfo(dent.Name()); err == nil {
+				keys[info.Event] = info.Time.Format(clipTimeFmt)
+			}
+		}
+	}
+
+	days := cam.settings().DeleteDays
+	maxAge := time.Duration(days) * time.Hour * 24
+	groups := map[string]*fileGroup{}
+	var candidates []*fileGroup
+	for _, dent := range dents {
+		dname := dent.Name()
+		if dname[0] == '.' {
+			// our own state (e.g. the journal)
+			continue
+		}
+		gk := dname
+		if id, ok := cam.clipID(dname); ok {
+			key := keys[id]
+			if key == "" || !cam.finished(key) {
+				if age := time.Since(dent.ModTime()); age > maxAge {
+					log.Printf("%v: keeping %v past retention (%v old): not uploaded yet", cam.ID, cam.fq(dname), age)
+				}
+				continue
+			}
+			gk = "clip " + key
+		}
+		g, ok := groups[gk]
+		if !ok {
+			g = &fileGroup{}
+			groups[gk] = g
+			candidates = append(candidates, g)
+		}
+		g.add(dent)
+	}
+
+	// A clip's files all go together, the .avi last: without it, the
+	// rest couldn't be matched up with the journal.
+	remove := func(g *fileGroup, reason string) bool {
+		sort.SliceStable(g.files, func(i, j int) bool {
+			return !strings.HasSuffix(g.files[i].Name(), ".avi") && strings.HasSuffix(g.files[j].Name(), ".avi")
+		})
+		for _, dent := range g.files {
+			dname := dent.Name()
+			log.Printf("%v: removing %v (modified %v): %v", cam.ID, cam.fq(dname), dent.ModTime(), reason)
+			if err := os.Remove(cam.fq(dname)); err != nil {
+				log.Printf("Error deleting %v: %v", cam.fq(dname), err)
+				return false
+			}
+			if strings.HasSuffix(dname, ".avi") {
+				if info, err := cam.parseClipInfo(dname); err == nil {
+					cam.jrnl.record(info.Time.Format(clipTimeFmt), func(s *clipState) { s.Cleaned = true })
+				}
+			}
+		}
+		return true
+	}
+
+	var keep []*fileGroup
+	for _, g := range candidates {
+		if age := time.Since(g.modified); age > maxAge {
+			remove(g, fmt.Sprintf("older than %v days (%v old)", days, age))
+			continue
+		}
+		keep = append(keep, g)
+	}
+
+	if err := cam.pruneQuarantine(maxAge); err != nil {
+		log.Printf("%v: error pruning quarantine: %v", cam.ID, err)
+	}
+
+	if *minFree == "" {
+		return nil
+	}
+	free, total, err := diskSpace(cam.Dir)
+	if err != nil {
+		return fmt.Errorf("checking free space: %v", err)
+	}
+	want, err := freeTarget(*minFree, total)
+	if err != nil {
+		return err
+	}
+	if free >= want {
+		return nil
+	}
+
+	sort.Slice(keep, func(i, j int) bool { return keep[i].modified.Before(keep[j].modified) })
+	for _, g := range keep {
+		if free >= want {
+			break
+		}
+		if remove(g, fmt.Sprintf("only %v free, want %v", humanize.Bytes(free), humanize.Bytes(want))) {
+			free += g.size
+		}
+	}
+	if free < want {
+		log.Printf("%v: still only %v free (want %v) with nothing uploaded left to remove",
+			cam.ID, humanize.Bytes(free), humanize.Bytes(want))
+	}
+	return nil
+}
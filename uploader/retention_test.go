@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFreeTarget(t *testing.T) {
+	tests := []struct {
+		spec  string
+		total uint64
+		exp   uint64
+	}{
+		{"", 1000, 0},
+		{"10%", 1000, 100},
+		{"2KB", 1000, 2000},
+		{"0", 1000, 0},
+	}
+	for _, test := range tests {
+		got, err := freeTarget(test.spec, test.total)
+		if err != nil || got != test.exp {
+			t.Errorf("freeTarget(%q, %v) = %v, %v; want %v", test.spec, test.total, got, err, test.exp)
+		}
+	}
+	for _, spec := range []string{"lots", "110%", "x%"} {
+		if got, err := freeTarget(spec, 1000); err == nil {
+			t.Errorf("freeTarget(%q) = %v, want error", spec, got)
+		}
+	}
+}
+
+func TestRetentionKeepsPending(t *testing.T) {
+	dir, err := ioutil.TempDir("", "motion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []string{
+		"1-20170518102400.avi", "1-20170518102400-00.jpg", "1.details",
+		"2-20170518112400.avi", "2-20170518112400-00.jpg", "2.details",
+		"3-20170518122400-snapshot.jpg",
+	}
+	old := time.Now().Add(-10 * 24 * time.Hour)
+	for _, fn := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, fn), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filepath.Join(dir, fn), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cam := &camera{ID: "test", Dir: dir, DeleteDays: 3}
+	cam.jrnl, err = openJournal(filepath.Join(dir, ".journal"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cam.jrnl.record("20170518102400", func(s *clipState) {
+		s.Uploaded["mp4"], s.Uploaded["jpg"], s.Uploaded["avi"] = true, true, true
+	})
+	cam.jrnl.record("20170518112400", func(s *clipState) { s.Uploaded["jpg"] = true })
+
+	if err := cam.removeOldFiles(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for i, fn := range files {
+		_, err := os.Stat(filepath.Join(dir, fn))
+		if kept := err == nil; kept != (i >= 3 && i < 6) {
+			t.Errorf("%v kept = %v", fn, kept)
+		}
+	}
+	if !cam.jrnl.state("20170518102400").Cleaned {
+		t.Errorf("removed clip wasn't marked cleaned")
+	}
+}
+
+func TestRetentionRemovesWholeClips(t *testing.T) {
+	dir, err := ioutil.TempDir("", "motion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []string{
+		"1-20170518102400.avi", "1-20170518102400-00.jpg", "1.details",
+		"2-20170518112400.avi", "2-20170518112400-00.jpg", "2.details",
+	}
+	for i, fn := range files {
+		// The .avi is the oldest file.
+		mt := time.Now().Add(-time.Duration(10-i) * time.Minute)
+		if err := ioutil.WriteFile(filepath.Join(dir, fn), []byte(fn), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filepath.Join(dir, fn), mt, mt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	qdir := filepath.Join(dir, ".quarantine", "7-20170510000000")
+	if err := os.MkdirAll(qdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(qdir, "quarantine.json"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-10 * 24 * time.Hour)
+	if err := os.Chtimes(qdir, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	cam := &camera{ID: "test", Dir: dir, DeleteDays: 3}
+	cam.jrnl, err = openJournal(filepath.Join(dir, ".journal"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cam.jrnl.record("20170518102400", func(s *clipState) {
+		s.Uploaded["mp4"], s.Uploaded["jpg"], s.Uploaded["avi"] = true, true, true
+	})
+
+	// There'll never be enough free space, so everything uploaded goes.
+	oldFree := *minFree
+	defer func() { *minFree = oldFree }()
+	*minFree = "100%"
+	if err := cam.removeOldFiles(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for i, fn := range files {
+		_, err := os.Stat(filepath.Join(dir, fn))
+		if kept := err == nil; kept != (i >= 3) {
+			t.Errorf("%v kept = %v", fn, kept)
+		}
+	}
+	if !cam.jrnl.state("20170518102400").Cleaned {
+		t.Errorf("removed clip wasn't marked cleaned")
+	}
+	if _, err := os.Stat(qdir); !os.IsNotExist(err) {
+		t.Errorf("old quarantined clip is still there: %v", err)
+	}
+}
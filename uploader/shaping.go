@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"golang.org/x/time/rate"
+)
+
+var (
+	uploadRate   = flag.String("upload_rate", "", "maximum total upload rate per second (e.g. 500KB), empty for unlimited")
+	rateSchedule = flag.String("upload_rate_schedule", "",
+		"upload rates by time of day, overriding -upload_rate (e.g. 07:00-23:00=256KB,23:00-07:00=4MB)")
+	aviWindowStr = flag.String("avi_window", "", "only upload AVI originals during this time of day (e.g. 01:00-06:00)")
+)
+
+// Largest single request for tokens from the limiter.
+const uploadBurst = 64 << 10
+
+// errHeld means some of a clip was deliberately left for later.
+var errHeld = errors.New("held for upload window")
+
+// A window is a time of day range, which may wrap past midnight.
+type window struct {
+	start, end time.Duration
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func parseWindow(s string) (window, error) {
+	a := strings.Split(s, "-")
+	if len(a) != 2 {
+		return window{}, fmt.Errorf("invalid window %q, want HH:MM-HH:MM", s)
+	}
+	start, err := parseTimeOfDay(a[0])
+	if err != nil {
+		return window{}, fmt.Errorf("invalid window start in %q: %v", s, err)
+	}
+	end, err := parseTimeOfDay(a[1])
+	if err != nil {
+		return window{}, fmt.Errorf("invalid window end in %q: %v", s, err)
+	}
+	return window{start, end}, nil
+}
+
+func (w window) contains(t time.Time) bool {
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+	if w.start <= w.end {
+		return d >= w.start && d < w.end
+	}
+	return d >= w.start || d < w.end
+}
+
+type rateWindow struct {
+	window
+	limit rate.Limit
+}
+
+var (
+	limiter     = rate.NewLimiter(rate.Inf, uploadBurst)
+	defaultRate = rate.Inf
+	rateWindows []rateWindow
+	aviWindow   *window
+)
+
+func parseRate(s string) (rate.Limit, error) {
+	if s == "" {
+		return rate.Inf, nil
+	}
+	n, err := humanize.ParseBytes(s)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return rate.Inf, nil
+	}
+	return rate.Limit(n), nil
+}
+
+func initShaping() {
+	var err error
+	if defaultRate, err = parseRate(*uploadRate); err != nil {
+		log.Fatalf("Invalid -upload_rate %q: %v", *uploadRate, err)
+	}
+	if *rateSchedule != "" {
+		for _, s := range strings.Split(*rateSchedule, ",") {
+			a := strings.SplitN(s, "=", 2)
+			if len(a) != 2 {
+				log.Fatalf("Invalid -upload_rate_schedule entry %q, want window=rate", s)
+			}
+			w, err := parseWindow(a[0])
+			if err != nil {
+				log.Fatalf("Invalid -upload_rate_schedule: %v", err)
+			}
+			l, err := parseRate(a[1])
+			if err != nil {
+				log.Fatalf("Invalid -upload_rate_schedule rate %q: %v", a[1], err)
+			}
+			rateWindows = append(rateWindows, rateWindow{w, l})
+		}
+	}
+	if *aviWindowStr != "" {
+		w, err := parseWindow(*aviWindowStr)
+		if err != nil {
+			log.Fatalf("Invalid -avi_window: %v", err)
+		}
+		aviWindow = &w
+	}
+}
+
+// currentRate is the upload rate limit in effect at t.
+func currentRate(t time.Time) rate.Limit {
+	for _, w := range rateWindows {
+		if w.contains(t) {
+			return w.limit
+		}
+	}
+	return defaultRate
+}
+
+// holdAVI reports whether AVI originals should wait for their window.
+func holdAVI(t time.Time) bool {
+	return aviWindow != nil && !aviWindow.contains(t)
+}
+
+// throttle waits until we're allowed to send n more bytes.
+func throttle(ctx context.Context, n int) error {
+	if l := currentRate(time.Now()); l != limiter.Limit() {
+		if l == rate.Inf {
+			log.Printf("Upload rate is now unlimited")
+		} else {
+			log.Printf("Upload rate is now %v/s", humanize.Bytes(uint64(l)))
+		}
+		limiter.SetLimit(l)
+	}
+	for n > 0 {
+		c := n
+		if c > uploadBurst {
+			c = uploadBurst
+		}
+		if err := limiter.WaitN(ctx, c); err != nil {
+			return err
+		}
+		n -= c
+	}
+	return nil
+}
+
+// throttledReader shares the global upload rate among all readers.
+type throttledReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > uploadBurst {
+		p = p[:uploadBurst]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := throttle(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
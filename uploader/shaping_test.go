@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindows(t *testing.T) {
+	at := func(h, m int) time.Time {
+		return time.Date(2017, 5, 18, h, m, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		w    string
+		t    time.Time
+		want bool
+	}{
+		{"01:00-06:00", at(0, 59), false},
+		{"01:00-06:00", at(1, 0), true},
+		{"01:00-06:00", at(5, 59), true},
+		{"01:00-06:00", at(6, 0), false},
+		{"23:00-07:00", at(23, 30), true},
+		{"23:00-07:00", at(3, 0), true},
+		{"23:00-07:00", at(7, 0), false},
+		{"23:00-07:00", at(12, 0), false},
+	}
+
+	for _, test := range tests {
+		w, err := parseWindow(test.w)
+		if err != nil {
+			t.Fatalf("parseWindow(%q): %v", test.w, err)
+		}
+		if got := w.contains(test.t); got != test.want {
+			t.Errorf("%v contains %v = %v, want %v", test.w, test.t.Format("15:04"), got, test.want)
+		}
+	}
+
+	for _, bad := range []string{"", "01:00", "1-2", "01:00-25:00"} {
+		if w, err := parseWindow(bad); err == nil {
+			t.Errorf("parseWindow(%q) = %v, want error", bad, w)
+		}
+	}
+}
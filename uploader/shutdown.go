@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var grace = flag.Duration("grace", 2*time.Minute, "how long to let in-flight uploads finish when shutting down")
+
+// A drainer keeps track of work in flight so shutdown can let it
+// finish without picking up anything new.
+type drainer struct {
+	mu       sync.Mutex
+	n        int
+	stopping chan struct{}
+	idle     chan struct{}
+}
+
+func newDrainer() *drainer {
+	return &drainer{stopping: make(chan struct{}), idle: make(chan struct{})}
+}
+
+var work = newDrainer()
+
+// begin registers the start of some work, returning false if we're
+// shutting down and it shouldn't be started.
+func (d *drainer) begin() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopped() {
+		return false
+	}
+	d.n++
+	return true
+}
+
+func (d *drainer) end() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.n--
+	if d.n == 0 && d.stopped() {
+		close(d.idle)
+	}
+}
+
+func (d *drainer) stopped() bool {
+	select {
+	case <-d.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// drain stops new work from starting and returns a channel that's
+// closed once everything in flight has finished.
+func (d *drainer) drain() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.stopped() {
+		close(d.stopping)
+		if d.n == 0 {
+			close(d.idle)
+		}
+	}
+	return d.idle
+}
+
+// handleSignals drains work on SIGINT or SIGTERM, calling abort once
+// it's done, the grace period is over, or we're signalled again.
+func handleSignals(abort context.CancelFunc) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-sigs
+		log.Printf("Got %v, waiting up to %v for uploads in flight", sig, *grace)
+		select {
+		case <-work.drain():
+			log.Printf("Everything in flight is done")
+		case <-time.After(*grace):
+			log.Printf("Grace period is over, aborting uploads in flight")
+		case sig := <-sigs:
+			log.Printf("Got %v again, aborting uploads in flight", sig)
+		}
+		abort()
+	}()
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDrainer(t *testing.T) {
+	d := newDrainer()
+	if !d.begin() {
+		t.Fatalf("couldn't begin work before draining")
+	}
+
+	idle := d.drain()
+	if d.begin() {
+		t.Errorf("began work while draining")
+	}
+	select {
+	case <-idle:
+		t.Fatalf("idle with work in flight")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	d.end()
+	select {
+	case <-idle:
+	case <-time.After(time.Second):
+		t.Fatalf("not idle after work finished")
+	}
+	// Draining again is harmless.
+	<-d.drain()
+}
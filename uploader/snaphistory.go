@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/reye/vidtool"
+)
+
+var (
+	snapEvery    = flag.Duration("snapshot_every", 0, "keep one snapshot this often as history (0 keeps only the latest)")
+	snapDays     = flag.Int("snapshot_days", 7, "how many days of snapshot history to keep")
+	timelapseDay = flag.String("timelapse", "", "build and upload each camera's time-lapse of its snapshot history for this day (YYYY-MM-DD or yesterday), then exit")
+	timelapseFPS = flag.Int("timelapse_fps", 24, "frames per second in time-lapse videos")
+)
+
+// snapHistory remembers the newest snapshot a camera kept as history.
+type snapHistory struct {
+	mu     sync.Mutex
+	last   time.Time
+	loaded bool
+}
+
+// historyPath is where a camera keeps its snapshot history.  It's a
+// dot directory, so the clip scans and retention leave it alone.
+func (cam *camera) historyPath() string {
+	return cam.fq(".snapshots")
+}
+
+// historyFiles returns the snapshots kept as history, oldest first.
+func (cam *camera) historyFiles() ([]string, []time.Time, error) {
+	fis, err := ioutil.ReadDir(cam.historyPath())
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var names []string
+	var times []time.Time
+	for _, fi := range fis {
+		if !strings.HasSuffix(fi.Name(), ".jpg") {
+			continue
+		}
+		ts, err := time.ParseInLocation(clipTimeFmt, strings.TrimSuffix(fi.Name(), ".jpg"), cam.naming().loc)
+		if err != nil {
+			continue
+		}
+		names = append(names, filepath.Join(cam.historyPath(), fi.Name()))
+		times = append(times, ts)
+	}
+	// The names sort by time.
+	return names, times, nil
+}
+
+// historyDue reports whether a snapshot taken at ts starts a new
+// history interval, and so should be kept.
+func (cam *camera) historyDue(ts time.Time) bool {
+	if cam.SnapshotEvery <= 0 {
+		return false
+	}
+	h := &cam.history
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.loaded {
+		_, times, err := cam.historyFiles()
+		if err != nil {
+			log.Printf("%v: reading snapshot history: %v", cam.ID, err)
+		}
+		if len(times) > 0 {
+			h.last = times[len(times)-1]
+		}
+		h.loaded = true
+	}
+	return ts.After(h.last) && !ts.Truncate(cam.SnapshotEvery).Equal(h.last.Truncate(cam.SnapshotEvery))
+}
+
+// keepSnapshot adds the snapshot sn, taken at ts, to the history.
+func (cam *camera) keepSnapshot(sn string, ts time.Time) error {
+	h := &cam.history
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !ts.After(h.last) {
+		// Someone else got there first.
+		return nil
+	}
+	if err := os.MkdirAll(cam.historyPath(), 0755); err != nil {
+		return err
+	}
+	dest := filepath.Join(cam.historyPath(), ts.Format(clipTimeFmt)+".jpg")
+	if err := os.Link(cam.fq(sn), dest); err != nil {
+		if err := copyFile(cam.fq(sn), dest); err != nil {
+			return err
+		}
+	}
+	h.last = ts
+	return nil
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dest)
+		return err
+	}
+	return out.Close()
+}
+
+// pruneHistory removes snapshots kept longer than SnapshotDays.
+func (cam *camera) pruneHistory() error {
+	names, times, err := cam.historyFiles()
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-time.Duration(cam.SnapshotDays) * 24 * time.Hour)
+	for i, fn := range names {
+		if !times[i].Before(cutoff) {
+			break
+		}
+		if err := os.Remove(fn); err != nil {
+			log.Printf("Error deleting %q: %v", fn, err)
+		}
+	}
+	return nil
+}
+
+// parseDay reads a -timelapse day in loc.
+func parseDay(s string, loc *time.Location) (time.Time, error) {
+	if s == "yesterday" {
+		y, m, d := time.Now().In(loc).AddDate(0, 0, -1).Date()
+		return time.Date(y, m, d, 0, 0, 0, 0, loc), nil
+	}
+	return time.ParseInLocation("2006-01-02", s, loc)
+}
+
+// dayFrames returns the history snapshots taken on the day starting at
+// day, oldest first.
+func (cam *camera) dayFrames(day time.Time) ([]string, error) {
+	names, times, err := cam.historyFiles()
+	if err != nil {
+		return nil, err
+	}
+	end := day.AddDate(0, 0, 1)
+	var rv []string
+	for i, fn := range names {
+		if !times[i].Before(day) && times[i].Before(end) {
+			rv = append(rv, fn)
+		}
+	}
+	return rv, nil
+}
+
+// uploadTimelapse builds a time-lapse of the given day's snapshot
+// history and uploads it alongside the camera's clips.
+func (cam *camera) uploadTimelapse(ctx context.Context, day time.Time) error {
+	frames, err := cam.dayFrames(day)
+	if err != nil {
+		return err
+	}
+	if len(frames) == 0 {
+		log.Printf("%v: no snapshots kept for %v, skipping time-lapse", cam.ID, day.Format("2006-01-02"))
+		return nil
+	}
+
+	oname := day.Format("20060102") + "-timelapse.mp4"
+	local := filepath.Join(".snapshots", oname)
+	dur, err := vidtool.Timelapse(ctx, frames, *timelapseFPS, cam.fq(local))
+	if err != nil {
+		return fmt.Errorf("building time-lapse: %v", err)
+	}
+	defer os.Remove(cam.fq(local))
+
+	attrs := objectAttrs{
+		ContentType: "video/mp4",
+		Metadata: map[string]string{
+			"camera":   cam.ID,
+			"captured": day.Format(time.RFC3339),
+			"duration": dur.String(),
+			"frames":   fmt.Sprint(len(frames)),
+			"kind":     "timelapse",
+		},
+	}
+	if err := cam.uploadOne(ctx, local, clip{}, cam.objectName(oname), attrs); err != nil {
+		return err
+	}
+	log.Printf("%v: uploaded %v time-lapse of %v snapshots (%v)", cam.ID, day.Format("2006-01-02"), len(frames), dur)
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "motion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cam := &camera{ID: "test", Dir: dir, SnapshotEvery: 10 * time.Minute, SnapshotDays: 2}
+	y, m, d := time.Now().AddDate(0, 0, -1).Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+	var kept []string
+	for _, m := range []int{0, 1, 9, 10, 25, 26, 40} {
+		ts := day.Add(time.Duration(m) * time.Minute)
+		sn := ts.Format(clipTimeFmt) + "-snapshot.jpg"
+		if err := ioutil.WriteFile(cam.fq(sn), []byte(sn), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if !cam.historyDue(ts) {
+			continue
+		}
+		if err := cam.keepSnapshot(sn, ts); err != nil {
+			t.Fatalf("keepSnapshot(%v): %v", sn, err)
+		}
+		kept = append(kept, filepath.Join(cam.historyPath(), ts.Format(clipTimeFmt)+".jpg"))
+	}
+	if len(kept) != 4 {
+		t.Errorf("kept %v, want one from each of 4 intervals", kept)
+	}
+
+	frames, err := cam.dayFrames(day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != len(kept) {
+		t.Fatalf("dayFrames = %v, want %v", frames, kept)
+	}
+	for i := range frames {
+		if frames[i] != kept[i] {
+			t.Errorf("frame %v = %v, want %v", i, frames[i], kept[i])
+		}
+	}
+
+	// A fresh start picks up where the history left off.
+	again := &camera{ID: "test", Dir: dir, SnapshotEvery: 10 * time.Minute}
+	if again.historyDue(day.Add(45 * time.Minute)) {
+		t.Errorf("a snapshot in the last kept interval is due after a restart")
+	}
+
+	cam.SnapshotDays = 0
+	if err := cam.pruneHistory(); err != nil {
+		t.Fatal(err)
+	}
+	if frames, _ := cam.dayFrames(day); len(frames) != 0 {
+		t.Errorf("after pruning, still have %v", frames)
+	}
+}
+
+func TestParseDay(t *testing.T) {
+	loc := time.FixedZone("test", -7*3600)
+	got, err := parseDay("2017-05-18", loc)
+	if err != nil || !got.Equal(time.Date(2017, 5, 18, 0, 0, 0, 0, loc)) {
+		t.Errorf("parseDay = %v, %v", got, err)
+	}
+	got, err = parseDay("yesterday", loc)
+	if err != nil || time.Since(got) < 24*time.Hour || time.Since(got) > 48*time.Hour {
+		t.Errorf("parseDay(yesterday) = %v, %v", got, err)
+	}
+	if _, err := parseDay("someday", loc); err == nil {
+		t.Errorf("parseDay(someday) didn't fail")
+	}
+}
+
+func TestUploadSnapshotsRemovesAll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "motion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A store that can't be written to, so the upload fails.
+	blocked := filepath.Join(dir, ".blocked")
+	if err := ioutil.WriteFile(blocked, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cam := &camera{ID: "test", Dir: dir, sto: &localStore{blocked}, SnapshotTimeout: time.Second}
+	for _, fn := range []string{"01-20170518102400-snapshot.jpg", "02-20170518102300-snapshot.jpg",
+		"webcam-snapshot.jpg", "12-20170518102400.avi"} {
+		if err := ioutil.WriteFile(cam.fq(fn), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("01-20170518102400-snapshot.jpg", cam.fq("lastsnap.jpg")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cam.uploadSnapshots(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// As ever, snapshots are only worth one try.
+	left, _ := filepath.Glob(cam.fq("[0-9a-z]*"))
+	if len(left) != 1 || filepath.Base(left[0]) != "12-20170518102400.avi" {
+		t.Errorf("left behind %v, want only the clip", left)
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/dustin/httputil"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+var (
+	storeType   = flag.String("store", "gcs", "where to store media (gcs, local, s3)")
+	storePath   = flag.String("store_path", "", "base directory for the local store")
+	s3Endpoint  = flag.String("s3_endpoint", "", "S3-compatible endpoint (host:port)")
+	s3AccessKey = flag.String("s3_access_key", "", "S3 access key")
+	s3SecretKey = flag.String("s3_secret_key", "", "S3 secret key")
+	s3Region    = flag.String("s3_region", "", "S3 region")
+	s3Insecure  = flag.Bool("s3_insecure", false, "talk to the S3 endpoint over plain http")
+)
+
+// objectAttrs are the attributes we attach to an object when storing it.
+// If Sums is set, the store should refuse content that doesn't match.
+type objectAttrs struct {
+	ContentType string
+	Metadata    map[string]string
+	Sums        *checksums `json:"-"`
+}
+
+// A blobStore is somewhere we can keep clips and snapshots.
+type blobStore interface {
+	// Put stores the contents of r (size bytes) under name.
+	Put(ctx context.Context, name string, r io.Reader, size int64, attrs objectAttrs) error
+	// Copy copies the object src to dst within the store.
+	Copy(ctx context.Context, dst, src string) error
+	// Delete removes the named object.
+	Delete(ctx context.Context, name string) error
+	// Stat describes the named object as stored.
+	Stat(ctx context.Context, name string) (objectInfo, error)
+}
+
+// initStore sets up a client for the configured kind of store and
+// returns a function for getting a blobStore for a particular bucket.
+// The local store has no buckets, so everything goes under -store_path.
+func initStore(ctx context.Context) (func(bucket string) blobStore, error) {
+	switch *storeType {
+	case "gcs":
+		client, err := storage.NewClient(ctx, option.WithServiceAccountFile(*authFile))
+		if err != nil {
+			return nil, err
+		}
+		hc, _, err := htransport.NewClient(ctx, option.WithServiceAccountFile(*authFile),
+			option.WithScopes(storage.ScopeReadWrite))
+		if err != nil {
+			return nil, err
+		}
+		return func(bucket string) blobStore {
+			return &gcsStore{client.Bucket(bucket), hc, bucket}
+		}, nil
+	case "local":
+		if *storePath == "" {
+			return nil, fmt.Errorf("local store requires -store_path")
+		}
+		return func(string) blobStore { return &localStore{*storePath} }, nil
+	case "s3":
+		client, err := minio.New(*s3Endpoint, &minio.Options{
+			Creds:  credentials.NewStaticV4(*s3AccessKey, *s3SecretKey, ""),
+			Secure: !*s3Insecure,
+			Region: *s3Region,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return func(bucket string) blobStore { return &s3Store{client, bucket} }, nil
+	}
+	return nil, fmt.Errorf("unknown store type %q", *storeType)
+}
+
+// gcsStore keeps objects in a Google Cloud Storage bucket.
+type gcsStore struct {
+	bucket *storage.BucketHandle
+
+	// For resumable uploads, which the storage client doesn't expose.
+	hc   *http.Client
+	name string
+}
+
+func (g *gcsStore) Put(ctx context.Context, name string, r io.Reader, size int64, attrs objectAttrs) error {
+	w := g.bucket.Object(name).NewWriter(ctx)
+	w.ObjectAttrs.ContentType = attrs.ContentType
+	w.ObjectAttrs.Metadata = attrs.Metadata
+	if attrs.Sums != nil {
+		w.ObjectAttrs.MD5 = attrs.Sums.MD5
+		w.ObjectAttrs.CRC32C = attrs.Sums.CRC32C
+		w.SendCRC32C = true
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func (g *gcsStore) Copy(ctx context.Context, dst, src string) error {
+	_, err := g.bucket.Object(dst).CopierFrom(g.bucket.Object(src)).Run(ctx)
+	return err
+}
+
+func (g *gcsStore) Delete(ctx context.Context, name string) error {
+	return g.bucket.Object(name).Delete(ctx)
+}
+
+func (g *gcsStore) Stat(ctx context.Context, name string) (objectInfo, error) {
+	attrs, err := g.bucket.Object(name).Attrs(ctx)
+	if err != nil {
+		return objectInfo{}, err
+	}
+	return objectInfo{Size: attrs.Size, MD5: attrs.MD5, CRC32C: attrs.CRC32C, HasCRC32C: true}, nil
+}
+
+func (g *gcsStore) StartResumable(ctx context.Context, name string, size int64, attrs objectAttrs) (string, error) {
+	m := map[string]interface{}{
+		"name":        name,
+		"contentType": attrs.ContentType,
+		"metadata":    attrs.Metadata,
+	}
+	if attrs.Sums != nil {
+		var crc [4]byte
+		binary.BigEndian.PutUint32(crc[:], attrs.Sums.CRC32C)
+		m["md5Hash"] = base64.StdEncoding.EncodeToString(attrs.Sums.MD5)
+		m["crc32c"] = base64.StdEncoding.EncodeToString(crc[:])
+	}
+	j, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	u := "https://storage.googleapis.com/upload/storage/v1/b/" + url.PathEscape(g.name) +
+		"/o?uploadType=resumable"
+	req, err := http.NewRequest("POST", u, bytes.NewReader(j))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", attrs.ContentType)
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+	res, err := g.hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return "", httputil.HTTPError(res)
+	}
+	return res.Header.Get("Location"), nil
+}
+
+// gcsOffset interprets the response to a resumable upload request.
+func gcsOffset(res *http.Response, size int64) (int64, error) {
+	switch res.StatusCode {
+	case 200, 201:
+		return size, nil
+	case 308:
+		// Range: bytes=0-n means we've got n+1 bytes.
+		r := res.Header.Get("Range")
+		if r == "" {
+			return 0, nil
+		}
+		i := strings.LastIndexByte(r, '-')
+		n, err := strconv.ParseInt(r[i+1:], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid range %q: %v", r, err)
+		}
+		return n + 1, nil
+	}
+	return 0, httputil.HTTPError(res)
+}
+
+func (g *gcsStore) Resume(ctx context.Context, session string, size int64) (int64, error) {
+	req, err := http.NewRequest("PUT", session, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+	res, err := g.hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	return gcsOffset(res, size)
+}
+
+func (g *gcsStore) PutChunk(ctx context.Context, session string, chunk []byte, off, size int64) (int64, error) {
+	req, err := http.NewRequest("PUT", session, bytes.NewReader(chunk))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", off, off+int64(len(chunk))-1, size))
+	res, err := g.hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	return gcsOffset(res, size)
+}
+
+// s3Store keeps objects in an S3-compatible bucket.
+type s3Store struct {
+	client *minio.Client
+	bucket string
+}
+
+func (s *s3Store) Put(ctx context.Context, name string, r io.Reader, size int64, attrs objectAttrs) error {
+	_, err := s.client.PutObject(ctx, s.bucket, name, r, size, minio.PutObjectOptions{
+		ContentType:    attrs.ContentType,
+		UserMetadata:   attrs.Metadata,
+		SendContentMd5: attrs.Sums != nil,
+	})
+	return err
+}
+
+func (s *s3Store) Copy(ctx context.Context, dst, src string) error {
+	_, err := s.client.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: s.bucket, Object: dst},
+		minio.CopySrcOptions{Bucket: s.bucket, Object: src})
+	return err
+}
+
+func (s *s3Store) Delete(ctx context.Context, name string) error {
+	return s.client.RemoveObject(ctx, s.bucket, name, minio.RemoveObjectOptions{})
+}
+
+func (s *s3Store) Stat(ctx context.Context, name string) (objectInfo, error) {
+	oi, err := s.client.StatObject(ctx, s.bucket, name, minio.StatObjectOptions{})
+	if err != nil {
+		return objectInfo{}, err
+	}
+	rv := objectInfo{Size: oi.Size}
+	// Only single part uploads have an MD5 for an ETag.
+	if md, err := hex.DecodeString(strings.Trim(oi.ETag, `"`)); err == nil && len(md) == md5.Size {
+		rv.MD5 = md
+	}
+	return rv, nil
+}
+
+// localStore keeps objects in a directory tree, with each object's
+// attributes alongside it in a .attrs JSON file.
+type localStore struct {
+	root string
+}
+
+func (l *localStore) path(name string) string {
+	return filepath.Join(l.root, filepath.FromSlash(name))
+}
+
+func attrsPath(p string) string {
+	return p + ".attrs"
+}
+
+// writeAtomic writes r to p via a temp file in the same directory so
+// readers never see a partial object.
+func writeAtomic(p string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+func (l *localStore) readAttrs(name string) (objectAttrs, error) {
+	var attrs objectAttrs
+	f, err := os.Open(attrsPath(l.path(name)))
+	if err != nil {
+		return attrs, err
+	}
+	defer f.Close()
+	return attrs, json.NewDecoder(f).Decode(&attrs)
+}
+
+func (l *localStore) writeAttrs(name string, attrs objectAttrs) error {
+	j, err := json.Marshal(attrs)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(attrsPath(l.path(name)), bytes.NewReader(j))
+}
+
+func (l *localStore) Put(ctx context.Context, name string, r io.Reader, size int64, attrs objectAttrs) error {
+	h := newHasher()
+	if err := writeAtomic(l.path(name), io.TeeReader(r, h)); err != nil {
+		return err
+	}
+	if attrs.Sums != nil {
+		if got := h.sums(); !bytes.Equal(got.MD5, attrs.Sums.MD5) || got.CRC32C != attrs.Sums.CRC32C {
+			os.Remove(l.path(name))
+			return fmt.Errorf("checksum mismatch storing %v: got %v, want %v", name, got, attrs.Sums)
+		}
+	}
+	return l.writeAttrs(name, attrs)
+}
+
+func (l *localStore) Copy(ctx context.Context, dst, src string) error {
+	attrs, err := l.readAttrs(src)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(l.path(src))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return l.Put(ctx, dst, f, st.Size(), attrs)
+}
+
+// Resumable uploads to a local store accumulate in a .partial file
+// named by the session until they're complete.
+func (l *localStore) StartResumable(ctx context.Context, name string, size int64, attrs objectAttrs) (string, error) {
+	p := l.path(name) + ".partial"
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+		return "", err
+	}
+	return name, l.writeAttrs(name+".partial", attrs)
+}
+
+func (l *localStore) Resume(ctx context.Context, session string, size int64) (int64, error) {
+	st, err := os.Stat(l.path(session) + ".partial")
+	if err != nil {
+		return 0, err
+	}
+	return st.Size(), nil
+}
+
+func (l *localStore) PutChunk(ctx context.Context, session string, chunk []byte, off, size int64) (int64, error) {
+	p := l.path(session) + ".partial"
+	f, err := os.OpenFile(p, os.O_WRONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.WriteAt(chunk, off); err != nil {
+		f.Close()
+		return 0, err
+	}
+	end := off + int64(len(chunk))
+	if err := f.Truncate(end); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	if end < size {
+		return end, nil
+	}
+
+	attrs, err := l.readAttrs(session + ".partial")
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Rename(p, l.path(session)); err != nil {
+		return 0, err
+	}
+	os.Remove(attrsPath(p))
+	return end, l.writeAttrs(session, attrs)
+}
+
+func (l *localStore) Stat(ctx context.Context, name string) (objectInfo, error) {
+	f, err := os.Open(l.path(name))
+	if err != nil {
+		return objectInfo{}, err
+	}
+	defer f.Close()
+	h := newHasher()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return objectInfo{}, err
+	}
+	sums := h.sums()
+	return objectInfo{Size: n, MD5: sums.MD5, CRC32C: sums.CRC32C, HasCRC32C: true}, nil
+}
+
+func (l *localStore) Delete(ctx context.Context, name string) error {
+	if err := os.Remove(l.path(name)); err != nil {
+		return err
+	}
+	if err := os.Remove(attrsPath(l.path(name))); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
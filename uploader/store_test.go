@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalStore(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sto := &localStore{dir}
+	attrs := objectAttrs{ContentType: "text/plain", Metadata: map[string]string{"camera": "test"}}
+	if err := sto.Put(ctx, "cam/a.txt", strings.NewReader("hello"), 5, attrs); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := sto.Copy(ctx, "cam/b.txt", "cam/a.txt"); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "cam", "b.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("copied contents = %q, want hello", b)
+	}
+	got, err := sto.readAttrs("cam/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, attrs) {
+		t.Errorf("copied attrs = %v, want %v", got, attrs)
+	}
+
+	bad := attrs
+	bad.Sums = &checksums{MD5: []byte("not the md5"), CRC32C: 1}
+	if err := sto.Put(ctx, "cam/c.txt", strings.NewReader("hello"), 5, bad); err == nil {
+		t.Errorf("Put with mismatched checksums succeeded")
+	}
+	if err := verifyObject(ctx, sto, "cam/b.txt", 5, checksums{MD5: []byte("nope")}); err == nil {
+		t.Errorf("verified b.txt against the wrong md5")
+	}
+
+	if err := sto.Delete(ctx, "cam/a.txt"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cam", "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("a.txt still exists after delete: %v", err)
+	}
+}
+
+func TestUploadSnapshotLocal(t *testing.T) {
+	ctx := context.Background()
+	src, err := ioutil.TempDir("", "motion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	dest, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	sn := "26-20170518102400-snapshot.jpg"
+	if err := ioutil.WriteFile(filepath.Join(src, sn), []byte("jpeg"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2017, 5, 18, 10, 24, 0, 0, time.UTC)
+
+	sto := &localStore{dest}
+	cam := &camera{ID: "test", Dir: src, sto: sto}
+	cam.applyDefaults()
+	if err := cam.uploadSnapshot(ctx, sn, ts); err != nil {
+		t.Fatalf("uploadSnapshot: %v", err)
+	}
+
+	for _, name := range []string{"__snaps/test/20170518102400.jpg", "test/lastsnap.jpg"} {
+		attrs, err := sto.readAttrs(name)
+		if err != nil {
+			t.Errorf("reading attrs of %v: %v", name, err)
+			continue
+		}
+		if attrs.ContentType != "image/jpeg" || attrs.Metadata["camera"] != "test" {
+			t.Errorf("attrs of %v = %v", name, attrs)
+		}
+	}
+}
+
+func TestLocalResumable(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte("0123456789"), 60000)
+	src := filepath.Join(dir, "src")
+	if err := ioutil.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	sto := &localStore{filepath.Join(dir, "dest")}
+	attrs := objectAttrs{ContentType: "video/avi"}
+
+	// Get partway through, then let uploadResumable pick it up.
+	session, err := sto.StartResumable(ctx, "cam/x.avi", int64(len(data)), attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sto.PutChunk(ctx, session, data[:256<<10], 0, int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	jrnl, err := openJournal(filepath.Join(dir, "journal"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jrnl.record("k", func(s *clipState) { s.Sessions["cam/x.avi"] = session })
+
+	if err := uploadResumable(ctx, sto, jrnl, f, int64(len(data)), "k", "cam/x.avi", attrs); err != nil {
+		t.Fatalf("uploadResumable: %v", err)
+	}
+	got, err := ioutil.ReadFile(sto.path("cam/x.avi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("uploaded %v bytes, want %v", len(got), len(data))
+	}
+	if s := jrnl.state("k").Sessions; len(s) != 0 {
+		t.Errorf("sessions left over: %v", s)
+	}
+}
+
+func TestResumableTruncated(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	if err := ioutil.WriteFile(src, bytes.Repeat([]byte("x"), 300<<10), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	jrnl, err := openJournal(filepath.Join(dir, "journal"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// We were told it was bigger than it is now.
+	sto := &localStore{filepath.Join(dir, "dest")}
+	done := make(chan error, 1)
+	go func() {
+		done <- uploadResumable(ctx, sto, jrnl, f, 1<<20, "k", "cam/x.avi", objectAttrs{})
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("uploading a truncated file succeeded")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("uploading a truncated file never finished")
+	}
+}
@@ -7,27 +7,26 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"log/syslog"
-	"net/http"
+	"log/slog"
 	"os"
 	"path"
-	"strconv"
+	"path/filepath"
 	"strings"
 	"time"
-	"unicode"
 
 	"github.com/dustin/go-humanize"
-	"github.com/dustin/httputil"
+	"github.com/dustin/reye/crypt"
+	"github.com/dustin/reye/logging"
 	"github.com/dustin/reye/vidtool"
 	"github.com/dustin/yellow"
 
-	"cloud.google.com/go/storage"
 	"golang.org/x/sync/errgroup"
-	"google.golang.org/api/option"
 )
 
 const clipTimeFmt = "20060102150405"
 
+var masterKey *crypt.MasterKey
+
 var (
 	cleanupFlag = flag.Bool("cleanup", false, "remove stuff when done")
 	camid       = flag.String("camid", "", "Camera ID")
@@ -35,18 +34,20 @@ var (
 	interval    = flag.Duration("duration", 30*time.Second, "How frequently to rescan")
 	useSyslog   = flag.Bool("syslog", false, "Log to syslog")
 	bucketName  = flag.String("bucket", "scenic-arc.appspot.com", "your app/bucket name to store media")
-	triggerAuth = flag.String("triggerAuth", "", "trigger auth token")
+	triggerAuth = flag.String("triggerAuth", "", "key for signing triggers, as id:secret")
 	triggerURL  = flag.String("triggerURL", "", "trigger URL")
 	deleteDays  = flag.Int("delete_days", 7, "delete files that have been here more than this many days")
 	snapTimeout = flag.Duration("snapshot_timeout", 5*time.Second, "deadline for uploading a snapshot image")
-
-	basePath string
+	masterFile  = flag.String("master_key", "", "encrypt uploads with data keys wrapped by the master key in this file")
+	watch       = flag.Bool("watch", true, "watch the directory for new files instead of only polling")
+	rescanEvery = flag.Duration("rescan_interval", 10*time.Minute, "how often to do a full rescan when watching")
 )
 
 type clip struct {
 	thumb, ovid, df os.FileInfo
 	details         map[string]string
 	ts              time.Time
+	frame           string
 }
 
 func (c clip) String() string {
@@ -55,173 +56,254 @@ func (c clip) String() string {
 		c.ts.Format(time.RFC3339), humanize.Bytes(uint64(size)))
 }
 
-func parseClipInfo(name string) (int, time.Time, error) {
-	parts := strings.FieldsFunc(name, func(r rune) bool {
-		return !unicode.IsNumber(r)
-	})
-	id, err := strconv.Atoi(parts[0])
-	if err != nil {
-		return 0, time.Time{}, fmt.Errorf("parsing clip info from  %v (%v): %v", name, parts, err)
-	}
-	ts, err := time.ParseInLocation(clipTimeFmt, parts[1], time.Local)
-	if err != nil {
-		return 0, time.Time{}, fmt.Errorf("parsing timestamp from %v (%v): %v", name, parts, err)
-	}
-	return id, ts, nil
-}
-
-func fq(fn string) string {
-	return path.Join(basePath, fn)
-}
-
 func estimateTime(size, kbps int) time.Duration {
 	return time.Duration(size) * time.Second / time.Duration(kbps)
 }
 
-func uploadOne(ctx context.Context, fn string, c clip, ob *storage.ObjectHandle, attrs storage.ObjectAttrs) error {
-	f, err := os.Open(fq(fn))
+// uploadClipObject uploads one of a clip's objects once there's an
+// upload slot for it.
+func (cam *camera) uploadClipObject(ctx context.Context, fn string, c clip, oname string, attrs objectAttrs) error {
+	if err := acquireUpload(ctx); err != nil {
+		return err
+	}
+	defer releaseUpload()
+	return cam.uploadOne(ctx, fn, c, oname, attrs)
+}
+
+func (cam *camera) uploadOne(ctx context.Context, fn string, c clip, oname string, attrs objectAttrs) error {
+	f, err := os.Open(cam.fq(fn))
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 	st, err := f.Stat()
 	if err != nil {
-		log.Printf("Can't stat file... not sure how to deadline...: %v", err)
+		return err
+	}
+
+	// Hash the local file up front so the store can reject anything
+	// that doesn't arrive intact, and so we can audit it later.
+	sums, err := hashFile(f)
+	if err != nil {
+		return err
+	}
+
+	md := map[string]string{}
+	for k, v := range c.details {
+		md[k] = v
+	}
+	for k, v := range attrs.Metadata {
+		md[k] = v
+	}
+	md["md5"] = fmt.Sprintf("%x", sums.MD5)
+	md["crc32c"] = fmt.Sprintf("%08x", sums.CRC32C)
+	attrs = objectAttrs{ContentType: attrs.ContentType, Metadata: md, Sums: &sums}
+
+	var r io.Reader = f
+	size := st.Size()
+	var stored *hasher
+	if masterKey != nil {
+		// Encrypted uploads are streamed, since a resumed session
+		// would need the same data key.  We only know what the
+		// ciphertext hashes to once it's sent.
+		er, emd, err := masterKey.Encrypt(f)
+		if err != nil {
+			return err
+		}
+		for k, v := range emd {
+			md[k] = v
+		}
+		stored = newHasher()
+		r, size = io.TeeReader(er, stored), crypt.EncryptedSize(size)
+		attrs.Sums = nil
+	} else if rs, ok := cam.sto.(resumableStore); ok && !c.ts.IsZero() && size >= *resumableMin {
+		if err := uploadResumable(ctx, rs, cam.jrnl, f, size, c.key(), oname, attrs); err != nil {
+			return err
+		}
+		if err := verifyObject(ctx, cam.sto, oname, size, sums); err != nil {
+			return err
+		}
+		bytesUploaded.WithLabelValues(attrs.ContentType).Add(float64(size))
+		logging.From(ctx).Info("uploaded", logging.Phase, "upload", logging.Object, oname, logging.Bytes, size)
+		return nil
 	}
 
 	// Just hang up if we don't get at least 12kBps.
-	deadline := (5 * time.Second) + estimateTime(int(st.Size()), 12000)
+	deadline := (5 * time.Second) + estimateTime(int(size), 12000)
 	if deadline > 10*time.Minute {
-		log.Printf("Might take a bit for %v (deadline is %v)", fn, deadline)
+		logging.From(ctx).Info("might take a bit", logging.Phase, "upload", logging.Object, oname,
+			logging.Bytes, size, "deadline", deadline)
 	}
 	defer yellow.DeadlineLogWarn(deadline*3/4, "Uploading %v", fn).Done()
 	ctx, cancel := context.WithTimeout(ctx, deadline)
 	defer cancel()
 
-	w := ob.NewWriter(ctx)
-	w.ObjectAttrs.ContentType = attrs.ContentType
-	w.ObjectAttrs.Metadata = map[string]string{}
-	for k, v := range c.details {
-		w.ObjectAttrs.Metadata[k] = v
+	if err := cam.sto.Put(ctx, oname, &throttledReader{ctx, r}, size, attrs); err != nil {
+		return err
 	}
-	for k, v := range attrs.Metadata {
-		w.ObjectAttrs.Metadata[k] = v
+	if stored != nil {
+		sums = stored.sums()
 	}
-	_, err = io.Copy(w, f)
-	if err != nil {
+	if err := verifyObject(ctx, cam.sto, oname, size, sums); err != nil {
 		return err
 	}
-	return w.Close()
+	bytesUploaded.WithLabelValues(attrs.ContentType).Add(float64(size))
+	logging.From(ctx).Info("uploaded", logging.Phase, "upload", logging.Object, oname, logging.Bytes, size)
+	return nil
 }
 
-func upload(ctx context.Context, sto *storage.Client, c clip) error {
+// key is the name this clip's objects are stored under.
+func (c clip) key() string {
+	return c.ts.Format(clipTimeFmt)
+}
+
+func (cam *camera) upload(ctx context.Context, c clip) error {
 	grp := errgroup.Group{}
 
-	bucket := sto.Bucket(*bucketName)
+	key := c.key()
+	st := cam.jrnl.state(key)
 
-	grp.Go(func() error {
-		oname := c.ts.Format(clipTimeFmt) + ".mp4"
-		odur, err := vidtool.Transcode(ctx, fq(c.ovid.Name()), fq(oname))
-		if err != nil {
+	// The thumbnail goes up first so the event can be shown (as still
+	// processing) while we work on the video.
+	if !st.Uploaded["jpg"] {
+		tattrs := objectAttrs{
+			ContentType: "image/jpeg",
+			Metadata: map[string]string{
+				"captured": c.ts.Format(time.RFC3339),
+				"camera":   cam.ID,
+			},
+		}
+		if c.frame != "" {
+			tattrs.Metadata["frame"] = c.frame
+		}
+		if err := cam.uploadClipObject(ctx, c.thumb.Name(), c, cam.objectName(key+".jpg"), tattrs); err != nil {
 			return err
 		}
-		defer os.Remove(fq(oname))
+		cam.jrnl.record(key, func(s *clipState) { s.Uploaded["jpg"] = true })
+	}
+	if !st.Announced && !st.Notified {
+		cam.announce(key, cam.announcement(c, statusPending, 0, false), func() {
+			cam.jrnl.record(key, func(s *clipState) { s.Announced = true })
+		})
+	}
+
+	odur := st.Duration
+	if !st.Uploaded["mp4"] {
+		grp.Go(func() error {
+			oname := key + ".mp4"
+			if _, err := os.Stat(cam.fq(oname)); !st.Transcoded || err != nil {
+				odur, err = transcode(ctx, cam.fq(c.ovid.Name()), cam.fq(oname))
+				if err != nil {
+					return err
+				}
+				cam.jrnl.record(key, func(s *clipState) {
+					s.Transcoded = true
+					s.Duration = odur
+				})
+			}
 
-		vob := bucket.Object(path.Join(*camid, oname))
-		vattrs := storage.ObjectAttrs{
-			ContentType: "video/mp4",
+			vattrs := objectAttrs{
+				ContentType: "video/mp4",
+				Metadata: map[string]string{
+					"captured": c.ts.Format(time.RFC3339),
+					"camera":   cam.ID,
+					"duration": odur.String(),
+				},
+			}
+			// Keep the transcoded output around until it's uploaded so
+			// a retry doesn't have to do it again.
+			if err := cam.uploadClipObject(ctx, oname, c, cam.objectName(oname), vattrs); err != nil {
+				return err
+			}
+			os.Remove(cam.fq(oname))
+			cam.jrnl.record(key, func(s *clipState) { s.Uploaded["mp4"] = true })
+			return nil
+		})
+	}
+
+	held := false
+	if !st.Uploaded["avi"] && holdAVI(time.Now()) {
+		logging.From(ctx).Info("holding the original until the AVI upload window", logging.Phase, "upload")
+		held = true
+	} else if !st.Uploaded["avi"] {
+		dur, err := vidtool.ClipDuration(ctx, cam.fq(c.ovid.Name()))
+		if err != nil {
+			return err
+		}
+		ovattrs := objectAttrs{
+			ContentType: "video/avi",
 			Metadata: map[string]string{
 				"captured": c.ts.Format(time.RFC3339),
-				"camera":   *camid,
-				"duration": odur.String(),
+				"camera":   cam.ID,
+				"duration": dur.String(),
 			},
 		}
-		return uploadOne(ctx, oname, c, vob, vattrs)
-
-	})
-
-	tob := bucket.Object(path.Join(*camid, c.ts.Format(clipTimeFmt)+".jpg"))
-	tattrs := storage.ObjectAttrs{
-		ContentType: "image/jpeg",
-		Metadata: map[string]string{
-			"captured": c.ts.Format(time.RFC3339),
-			"camera":   *camid,
-		},
-	}
-	grp.Go(func() error { return uploadOne(ctx, c.thumb.Name(), c, tob, tattrs) })
-
-	dur, err := vidtool.ClipDuration(ctx, fq(c.ovid.Name()))
-	if err != nil {
-		return err
-	}
-	ovob := bucket.Object(path.Join(*camid, c.ts.Format(clipTimeFmt)+".avi"))
-	ovattrs := storage.ObjectAttrs{
-		ContentType: "video/avi",
-		Metadata: map[string]string{
-			"captured": c.ts.Format(time.RFC3339),
-			"camera":   *camid,
-			"duration": dur.String(),
-		},
+		grp.Go(func() error {
+			if err := cam.uploadClipObject(ctx, c.ovid.Name(), c, cam.objectName(key+".avi"), ovattrs); err != nil {
+				return err
+			}
+			cam.jrnl.record(key, func(s *clipState) { s.Uploaded["avi"] = true })
+			return nil
+		})
 	}
-	grp.Go(func() error { return uploadOne(ctx, c.ovid.Name(), c, ovob, ovattrs) })
 
 	if err := grp.Wait(); err != nil {
 		return err
 	}
 
-	if err := notifyUpload(ctx, c); err != nil {
-		log.Printf("Error triggering notification: %v", err)
+	if !st.Notified {
+		cam.announceComplete(ctx, c, odur, !held)
 	}
 
+	if held {
+		return errHeld
+	}
 	return nil
 }
 
-func notifyUpload(ctx context.Context, c clip) error {
-	ctx, cancel := context.WithTimeout(ctx, time.Second)
-	defer cancel()
+// announceComplete tells the camera's sinks that the clip's uploaded,
+// recording that once they've all got it.  The clip's then cleaned up,
+// if everything's there.
+func (cam *camera) announceComplete(ctx context.Context, c clip, dur time.Duration, withAVI bool) {
+	key := c.key()
+	cam.announce(key, cam.announcement(c, statusComplete, dur, withAVI), func() {
+		cam.jrnl.record(key, func(s *clipState) { s.Notified = true })
+		if !withAVI {
+			return
+		}
+		if err := cam.finish(c); err != nil {
+			cam.failed(key, err)
+			logging.From(ctx).Error("cleanup failed", logging.Phase, "cleanup", "error", err)
+		}
+	})
+}
 
-	if *triggerURL == "" {
-		return nil
-	}
-	req, err := http.NewRequest("POST", *triggerURL, strings.NewReader(
-		"cam="+*camid+"&id="+c.ts.Format(clipTimeFmt)))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("content-type", "application/x-www-form-urlencoded")
-	req.Header.Set("x-reye", *triggerAuth)
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
+// finish cleans up after a clip that's done with.
+func (cam *camera) finish(c clip) error {
+	if err := cam.cleanup(c); err != nil {
+		return fmt.Errorf("cleaning up %v: %v", c, err)
 	}
-	defer res.Body.Close()
-	if res.StatusCode != 201 {
-		return httputil.HTTPError(res)
+	if *cleanupFlag {
+		cam.jrnl.record(c.key(), func(s *clipState) { s.Cleaned = true })
+		cam.clipLogger(c).Info("cleaned up", logging.Phase, "cleanup")
 	}
 	return nil
 }
 
-func initStorageClient(ctx context.Context) *storage.Client {
-	client, err := storage.NewClient(ctx, option.WithServiceAccountFile(*authFile))
-	if err != nil {
-		log.Fatalf("Can't init storage client: %v", err)
-	}
-	return client
-}
-
-func cleanup(c clip) error {
+func (cam *camera) cleanup(c clip) error {
 	if !*cleanupFlag {
 		return nil
 	}
 
-	if err := os.Remove(fq(c.thumb.Name())); err != nil {
+	if err := os.Remove(cam.fq(c.thumb.Name())); err != nil {
 		return err
 	}
 
-	if err := os.Remove(fq(c.ovid.Name())); err != nil {
+	if err := os.Remove(cam.fq(c.ovid.Name())); err != nil {
 		return err
 	}
 
-	if err := os.Remove(fq(c.df.Name())); err != nil {
+	if err := os.Remove(cam.fq(c.df.Name())); err != nil {
 		return err
 	}
 
@@ -248,16 +330,14 @@ func parseMap(r io.Reader) map[string]string {
 	return rv
 }
 
-func parseDetails(fn string) (int, map[string]string, error) {
-	parts := strings.FieldsFunc(fn, func(r rune) bool {
-		return !unicode.IsNumber(r)
-	})
-	id, err := strconv.Atoi(parts[0])
+func (cam *camera) parseDetails(fn string) (int, map[string]string, error) {
+	info, err := cam.naming().details.parse(fn, time.UTC)
 	if err != nil {
-		return 0, nil, fmt.Errorf("parsing clip info from %v (%v): %v", fn, parts, err)
+		return 0, nil, fmt.Errorf("parsing clip info from %v: %v", fn, err)
 	}
+	id := info.Event
 
-	f, err := os.Open(fq(fn))
+	f, err := os.Open(cam.fq(fn))
 	if err != nil {
 		return id, nil, err
 	}
@@ -266,63 +346,75 @@ func parseDetails(fn string) (int, map[string]string, error) {
 	return id, parseMap(f), nil
 }
 
-func uploadSnapshot(ctx context.Context, sto *storage.Client, sn string, ts time.Time) error {
-	ctx, cancel := context.WithTimeout(ctx, *snapTimeout)
+func (cam *camera) uploadSnapshot(ctx context.Context, sn string, ts time.Time) error {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, cam.settings().SnapshotTimeout)
 	defer cancel()
 
-	bucket := sto.Bucket(*bucketName)
-
-	ovob := bucket.Object(path.Join("__snaps", *camid, ts.Format(clipTimeFmt)+".jpg"))
-	ovattrs := storage.ObjectAttrs{
+	oname := path.Join("__snaps", cam.Prefix, ts.Format(clipTimeFmt)+".jpg")
+	ovattrs := objectAttrs{
 		ContentType: "image/jpeg",
 		Metadata: map[string]string{
-			"camera":   *camid,
+			"camera":   cam.ID,
 			"captured": ts.Format(time.RFC3339),
 		},
 	}
-	if err := uploadOne(ctx, sn, clip{}, ovob, ovattrs); err != nil {
+	// Snapshots we keep as history are kept by the app, too.
+	keep := cam.historyDue(ts)
+	if keep {
+		until := ts.Add(time.Duration(cam.SnapshotDays) * 24 * time.Hour)
+		ovattrs.Metadata["keep_until"] = until.Format(time.RFC3339)
+	}
+	if err := cam.uploadOne(ctx, sn, clip{}, oname, ovattrs); err != nil {
 		return err
 	}
 
-	last := bucket.Object(path.Join(*camid, "lastsnap.jpg"))
-	_, err := last.CopierFrom(ovob).Run(ctx)
-	return err
-}
+	if err := cam.sto.Copy(ctx, cam.objectName("lastsnap.jpg"), oname); err != nil {
+		return err
+	}
+	snapshotLatency.Observe(time.Since(start).Seconds())
 
-func parseSnapshotTime(f string) (time.Time, error) {
-	a := strings.Split(f, "-")
-	if len(a) < 2 {
-		return time.Time{}, fmt.Errorf("Invalid snapshot filename: %v", f)
+	if keep {
+		if err := cam.keepSnapshot(sn, ts); err != nil {
+			return fmt.Errorf("keeping snapshot history: %v", err)
+		}
 	}
-	return time.ParseInLocation(clipTimeFmt, a[1], time.Local)
+	return nil
 }
 
-func removeOldFiles(ctx context.Context, sto *storage.Client) error {
-	d, err := os.Open(basePath)
-	if err != nil {
-		return err
+// uploadLatestSnapshot uploads the snapshot lastsnap.jpg points to.
+func (cam *camera) uploadLatestSnapshot(ctx context.Context) error {
+	if !work.begin() {
+		return nil
 	}
-	defer d.Close()
-	dents, err := d.Readdir(-1)
+	defer work.end()
+
+	sn, err := os.Readlink(cam.fq("lastsnap.jpg"))
 	if err != nil {
-		return err
+		return fmt.Errorf("reading snapshot name: %v", err)
 	}
-
-	for _, dent := range dents {
-		if age := time.Since(dent.ModTime()); age > time.Duration(*deleteDays)*time.Hour*24 {
-			dname := dent.Name()
-			log.Printf("Removing file %v for being too old (%v was %v ago)", dname, dent.ModTime(), age)
-			if err := os.Remove(fq(dname)); err != nil {
-				log.Printf("Error deleting %v: %v", fq(dname), err)
-			}
+	ts, err := cam.parseSnapshotTime(filepath.Base(sn))
+	if err != nil {
+		return fmt.Errorf("parsing snapshot timestamp: %v", err)
+	}
+	if cam.paused(ts) || cam.paused(time.Now()) {
+		cam.count("paused")
+		// Held snapshots still go into the history, to be published
+		// with the day's time-lapse.
+		if cam.PausePolicy == pauseHold && cam.historyDue(ts) {
+			return cam.keepSnapshot(sn, ts)
 		}
+		return nil
 	}
-
+	if err := cam.uploadSnapshot(ctx, sn, ts); err != nil {
+		return err
+	}
+	cam.count("snapshots")
 	return nil
 }
 
-func uploadSnapshots(ctx context.Context, sto *storage.Client) error {
-	d, err := os.Open(basePath)
+func (cam *camera) uploadSnapshots(ctx context.Context) error {
+	d, err := os.Open(cam.Dir)
 	if err != nil {
 		return err
 	}
@@ -339,38 +431,189 @@ func uploadSnapshots(ctx context.Context, sto *storage.Client) error {
 
 		if dname == "lastsnap.jpg" {
 			// Upload the latest snapshot separately
-			sn, err := os.Readlink(fq(dname))
-			if err != nil {
-				log.Printf("Error reading snapshot name: %v", err)
-				continue
-			}
-			ts, err := parseSnapshotTime(sn)
-			if err != nil {
-				log.Printf("Error parsing snapshot timestamp: %v", err)
-				continue
-			}
-			snaps = append(snaps, fq(dname))
-			if err := uploadSnapshot(ctx, sto, sn, ts); err != nil {
-				log.Printf("Error uploading the latest snapshot: %v", err)
+			snaps = append(snaps, cam.fq(dname))
+			if err := cam.uploadLatestSnapshot(ctx); err != nil {
+				log.Printf("%v: error uploading the latest snapshot: %v", cam.ID, err)
 				continue
 			}
-		} else if strings.HasSuffix(dname, "-snapshot.jpg") {
+		} else if cam.isSnapshot(dname) || strings.HasSuffix(dname, "-snapshot.jpg") {
 			// Gather a snapshot to delete after this loop.
-			snaps = append(snaps, fq(dname))
+			snaps = append(snaps, cam.fq(dname))
 		}
 	}
 
+	// Anything worth keeping is linked into the history by now.
 	for _, s := range snaps {
 		if err := os.Remove(s); err != nil {
 			log.Printf("Error deleting %q: %v", s, err)
 		}
 	}
 
+	return cam.pruneHistory()
+}
+
+// addClipFile records dent as part of whichever clip it belongs to in
+// clips, returning the clip's id if it was a clip file at all.
+func (cam *camera) addClipFile(clips map[int]clip, dent os.FileInfo) (int, bool) {
+	dname := dent.Name()
+	if dname[0] == '.' {
+		// ignore dot files
+	} else if cam.isSnapshot(dname) {
+		// ignore snaps
+	} else if strings.HasSuffix(dname, ".details") {
+		id, details, err := cam.parseDetails(dname)
+		if err != nil {
+			log.Printf("error parsing %v: %v", dname, err)
+			return 0, false
+		}
+		c := clips[id]
+		c.df = dent
+		c.details = details
+		clips[id] = c
+		slog.Debug("parsed details", logging.Camera, cam.ID, "file", dname, "details", c.details)
+		return id, true
+	} else if strings.HasSuffix(dname, ".avi") {
+		info, err := cam.parseClipInfo(dname)
+		if err != nil {
+			log.Printf("error parsing %v: %v", dname, err)
+			return 0, false
+		}
+		c := clips[info.Event]
+		c.ovid = dent
+		c.ts = info.Time
+		clips[info.Event] = c
+		return info.Event, true
+	} else if strings.HasSuffix(dname, ".jpg") {
+		info, err := cam.parseClipInfo(dname)
+		if err != nil {
+			log.Printf("error parsing %v: %v", dname, err)
+			return 0, false
+		}
+		c := clips[info.Event]
+		c.thumb = dent
+		c.frame = info.Frame
+		clips[info.Event] = c
+		return info.Event, true
+	}
+	return 0, false
+}
+
+func (c clip) complete() bool {
+	return c.thumb != nil && c.ovid != nil && c.details != nil
+}
+
+// failed records a failed attempt at the clip stored under key.
+func (cam *camera) failed(key string, err error) {
+	clipsFailed.WithLabelValues(cam.ID).Inc()
+	cam.jrnl.failed(key, err)
+	cam.noteError(err)
+}
+
+func (cam *camera) uploadClip(ctx context.Context, c clip) error {
+	if !work.begin() {
+		return nil
+	}
+	defer work.end()
+
+	l := cam.clipLogger(c)
+	ctx = logging.With(ctx, l)
+	key := c.key()
+	st := cam.jrnl.state(key)
+	if st.Discovered.IsZero() {
+		clipsDiscovered.WithLabelValues(cam.ID).Inc()
+		cam.jrnl.record(key, func(*clipState) {})
+	}
+	if time.Now().Before(st.NextTry) {
+		// Still backing off from a previous failure.
+		cam.count("backing off")
+		return nil
+	}
+
+	if st.Filtered == "" && cam.finished(key) {
+		if !st.Notified {
+			// Uploaded, but not every sink has heard about it yet.
+			// It's cleaned up once they have.
+			cam.announceComplete(ctx, c, st.Duration, true)
+			return nil
+		}
+		// Already uploaded, and still here without -cleanup.  All
+		// that can be left to do is clean it up.
+		return cam.finish(c)
+	}
+
+	if st.Filtered == "" && cam.PausePolicy == pauseDiscard && len(st.Uploaded) == 0 && cam.paused(c.ts) {
+		l.Info("discarded while paused", logging.Phase, "pause")
+		cam.jrnl.record(key, func(s *clipState) { s.Filtered = "paused" })
+		st.Filtered = "paused"
+		cam.count("discarded")
+	} else if st.Filtered == "" && cam.paused(time.Now()) {
+		// Nothing's published while paused.  It goes up once the
+		// camera's resumed, as does anything already partly published.
+		cam.count("paused")
+		return nil
+	}
+
+	if len(st.Uploaded) == 0 && st.Filtered == "" {
+		keep, err := cam.applyFilters(ctx, c)
+		if err != nil {
+			cam.failed(key, err)
+			cam.count("failed")
+			return fmt.Errorf("filtering %v: %v", c, err)
+		}
+		if !keep {
+			st.Filtered = "dropped"
+			cam.count("filtered")
+		}
+	}
+	if st.Filtered != "" {
+		// Dropped clips are done with, just like uploaded ones.
+		if err := cam.cleanup(c); err != nil {
+			return fmt.Errorf("cleaning up %v: %v", c, err)
+		}
+		if *cleanupFlag {
+			cam.jrnl.record(key, func(s *clipState) { s.Cleaned = true })
+			l.Info("cleaned up", logging.Phase, "cleanup")
+		}
+		return nil
+	}
+
+	l.Info("uploading", logging.Phase, "upload", "video", c.ovid.Name(), "thumb", c.thumb.Name(),
+		logging.Bytes, c.ovid.Size()+c.thumb.Size())
+
+	if err := cam.upload(ctx, c); err == errHeld {
+		// Nothing's wrong, but we can't clean up until it's all there.
+		cam.count("held")
+		return nil
+	} else if err != nil {
+		cam.failed(key, err)
+		cam.count("failed")
+		l.Error("upload failed", logging.Phase, "upload", "error", err)
+		return fmt.Errorf("uploading %v: %v", c, err)
+	}
+	// Clips announced just now are cleaned up once the announcement's
+	// delivered.
+	if st.Notified {
+		if err := cam.finish(c); err != nil {
+			cam.failed(key, err)
+			cam.count("failed")
+			l.Error("cleanup failed", logging.Phase, "cleanup", "error", err)
+			return err
+		}
+	}
+	clipsUploaded.WithLabelValues(cam.ID).Inc()
+	cam.count("uploaded")
+	cam.noteUpload()
 	return nil
 }
 
-func uploadClips(ctx context.Context, sto *storage.Client) error {
-	d, err := os.Open(basePath)
+// clipLogger is the logger for everything done with one of the
+// camera's clips.
+func (cam *camera) clipLogger(c clip) *slog.Logger {
+	return slog.Default().With(logging.Camera, cam.ID, logging.Clip, c.key())
+}
+
+func (cam *camera) uploadClips(ctx context.Context) error {
+	d, err := os.Open(cam.Dir)
 	if err != nil {
 		return err
 	}
@@ -383,68 +626,68 @@ func uploadClips(ctx context.Context, sto *storage.Client) error {
 	clips := map[int]clip{}
 
 	for _, dent := range dents {
-		dname := dent.Name()
-		if dname[0] == '.' {
-			// ignore dot files
-		} else if dname == "lastsnap.jpg" || strings.HasSuffix(dname, "-snapshot.jpg") {
-			// ignore snaps
-		} else if strings.HasSuffix(dname, ".details") {
-			id, details, err := parseDetails(dname)
-			if err != nil {
-				log.Printf("error parsing %v: %v", dname, err)
-				continue
-			}
-			c := clips[id]
-			c.df = dent
-			c.details = details
-			clips[id] = c
-			log.Printf("Parsed details from %v: %v", dname, c.details)
-		} else if strings.HasSuffix(dname, ".avi") {
-			id, ts, err := parseClipInfo(dname)
-			if err != nil {
-				log.Printf("error parsing %v: %v", dname, err)
-				continue
-			}
-			c := clips[id]
-			c.ovid = dent
-			c.ts = ts
-			clips[id] = c
-		} else if strings.HasSuffix(dname, ".jpg") {
-			id, _, err := parseClipInfo(dname)
-			if err != nil {
-				log.Printf("error parsing %v: %v", dname, err)
-			}
-			c := clips[id]
-			c.thumb = dent
-			clips[id] = c
+		cam.addClipFile(clips, dent)
+	}
+
+	failed := 0
+	for id, c := range clips {
+		if !c.orphaned() || !work.begin() {
+			continue
+		}
+		salvaged, err := cam.salvage(ctx, id, c)
+		work.end()
+		if err != nil {
+			log.Printf("%v: error salvaging event %v: %v", cam.ID, id, err)
+			failed++
+		}
+		clips[id] = salvaged
+	}
+	// The queue sorts out the order; we just wait for every clip to
+	// have had its turn.
+	var results []<-chan error
+	for _, clip := range clips {
+		if clip.complete() {
+			results = append(results, clipWork.submit(ctx, cam, clip))
 		}
 	}
+	pendingClips.WithLabelValues(cam.ID).Set(float64(len(results)))
 
-	for id, clip := range clips {
-		if clip.thumb != nil && clip.ovid != nil && clip.details != nil {
-			log.Printf("%v -> %v", id, clip)
-			if err := upload(ctx, sto, clip); err != nil {
-				return fmt.Errorf("uploading %v: %v", clip, err)
-			}
-			if err := cleanup(clip); err != nil {
-				return fmt.Errorf("cleaning up %v: %v", clip, err)
-			}
+	for _, ch := range results {
+		if err := <-ch; err != nil {
+			log.Printf("%v: error %v", cam.ID, err)
+			failed++
 		}
 	}
+	if failed > 0 {
+		return fmt.Errorf("%v clips failed, will retry", failed)
+	}
 	return nil
 }
 
-func repeatedly(ctx context.Context, sto *storage.Client, name string, f func(context.Context, *storage.Client) error) error {
-	if err := f(ctx, sto); err != nil {
+func (cam *camera) repeatedly(ctx context.Context, name string, every time.Duration,
+	f func(context.Context) error) error {
+	passStarted(cam.ID, name)
+	if err := f(ctx); err != nil {
 		return err
 	}
+	passSucceeded(cam.ID, name)
 
-	if *interval > 0 {
+	if every > 0 {
 		go func() {
-			for range time.Tick(*interval) {
-				if err := f(ctx, sto); err != nil {
-					log.Printf("%v error: %v", name, err)
+			t := time.NewTicker(every)
+			defer t.Stop()
+			for {
+				select {
+				case <-t.C:
+				case <-work.stopping:
+					return
+				}
+				if err := f(ctx); err != nil {
+					log.Printf("%v: %v error: %v", cam.ID, name, err)
+					cam.noteError(fmt.Errorf("%v: %v", name, err))
+					continue
 				}
+				passSucceeded(cam.ID, name)
 			}
 		}()
 	}
@@ -452,37 +695,158 @@ func repeatedly(ctx context.Context, sto *storage.Client, name string, f func(co
 	return nil
 }
 
+// run starts all of the camera's scanning loops.
+func (cam *camera) run(ctx context.Context) {
+	// When we can watch the directory, the full scans are just a
+	// safety net for anything the watcher missed.
+	scanEvery := *interval
+	if *watch && *interval > 0 {
+		if err := cam.watchClips(ctx); err != nil {
+			log.Printf("Can't watch %v, falling back to polling: %v", cam.Dir, err)
+		} else {
+			scanEvery = *rescanEvery
+		}
+	}
+
+	// Failures from being interrupted aren't worth dying over.
+	if err := cam.repeatedly(ctx, "delete old files", *interval, cam.removeOldFiles); err != nil && ctx.Err() == nil {
+		log.Fatalf("%v: could not do initial old file deletion: %v", cam.ID, err)
+	}
+
+	if err := cam.repeatedly(ctx, "upload snaps", scanEvery, cam.uploadSnapshots); err != nil && ctx.Err() == nil {
+		log.Fatalf("%v: could not do initial snapshot upload: %v", cam.ID, err)
+	}
+
+	if err := cam.repeatedly(ctx, "upload clips", scanEvery, cam.uploadClips); err != nil && ctx.Err() == nil {
+		log.Fatalf("%v: could not do initial cilp upload: %v", cam.ID, err)
+	}
+}
+
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 
-	if *useSyslog {
-		sl, err := syslog.New(syslog.LOG_INFO, "uploader")
+	logging.MustSetup("uploader", *useSyslog)
+
+	cmd, args, dir, err := parseCommand(flag.Args())
+	if err == nil {
+		err = checkPoolFlags()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if cmd == "status" {
+		os.Exit(runStatus())
+	}
+
+	// ctx is only cancelled once we're done waiting for work in
+	// flight during shutdown.
+	ctx, abort := context.WithCancel(context.Background())
+	handleSignals(abort)
+
+	if *masterFile != "" {
+		mk, err := crypt.LoadMasterKey(*masterFile)
 		if err != nil {
-			log.Fatalf("Can't initialize syslog: %v", err)
+			log.Fatalf("Can't load master key: %v", err)
 		}
-		log.SetOutput(sl)
-		log.SetFlags(0)
+		masterKey = mk
+		log.Printf("Encrypting uploads with master key %v", masterKey.ID())
 	}
 
-	ctx := context.Background()
+	cams, err := loadCameras(dir)
+	if err != nil {
+		log.Fatalf("Can't load cameras: %v", err)
+	}
 
-	sto := initStorageClient(ctx)
+	if cmd == "list-pending" {
+		// The daemon may well be running, so leave its journals be.
+		for _, cam := range cams {
+			if cam.jrnl, err = readJournal(cam.journalFile(), 0); err != nil {
+				log.Fatalf("Can't read journal for %v: %v", cam.ID, err)
+			}
+		}
+		os.Exit(listPending(os.Stdout, cams))
+	}
 
-	basePath = flag.Arg(0)
+	openBucket, err := initStore(ctx)
+	if err != nil {
+		log.Fatalf("Can't init storage: %v", err)
+	}
 
-	if err := repeatedly(ctx, sto, "delete old files", removeOldFiles); err != nil {
-		log.Fatalf("Could not do initial old file deletion: %v", err)
+	initShaping()
+	transcodeSlots = make(chan bool, *transcoders)
+	// Retries go through the daemon if there is one, since it owns the
+	// journals.
+	if cmd == "retry" && daemon("/retry") != "" {
+		os.Exit(runRetry(ctx, nil, args[0]))
+	}
+	if err := startRemoteConfig(ctx, cams); err != nil {
+		log.Fatalf("Can't fetch camera config: %v", err)
+	}
+	for _, cam := range cams {
+		cam.sto = openBucket(cam.Bucket)
+		cam.initJournal()
+	}
+	if *timelapseDay != "" {
+		failed := false
+		for _, cam := range cams {
+			day, err := parseDay(*timelapseDay, cam.naming().loc)
+			if err != nil {
+				log.Fatalf("Invalid -timelapse %q: %v", *timelapseDay, err)
+			}
+			if err := cam.uploadTimelapse(ctx, day); err != nil {
+				log.Printf("%v: error uploading time-lapse: %v", cam.ID, err)
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return
 	}
 
-	if err := repeatedly(ctx, sto, "upload snaps", uploadSnapshots); err != nil {
-		log.Fatalf("Could not do initial snapshot upload: %v", err)
+	if err := startNotifiers(ctx, cams); err != nil {
+		log.Fatalf("Can't start notifiers: %v", err)
+	}
+	if err := startPauses(ctx, cams); err != nil {
+		log.Fatalf("Can't check for paused cameras: %v", err)
 	}
 
-	if err := repeatedly(ctx, sto, "upload clips", uploadClips); err != nil {
-		log.Fatalf("Could not do initial cilp upload: %v", err)
+	switch cmd {
+	case "once":
+		rv := runOnce(ctx, cams)
+		drainNotifiers(cams)
+		os.Exit(rv)
+	case "retry":
+		rv := runRetry(ctx, cams, args[0])
+		drainNotifiers(cams)
+		os.Exit(rv)
 	}
 
+	if err := startHeartbeats(ctx, cams); err != nil {
+		log.Fatalf("Can't start heartbeats: %v", err)
+	}
+	serveHTTP(ctx, cams)
+
+	grp := errgroup.Group{}
+	for _, cam := range cams {
+		cam := cam
+		grp.Go(func() error {
+			cam.run(ctx)
+			return nil
+		})
+	}
+	grp.Wait()
+
 	if *interval > 0 {
-		select {}
+		<-ctx.Done()
+	}
+
+	// Give anything we just aborted a moment to clean up after itself.
+	select {
+	case <-work.drain():
+	case <-time.After(5 * time.Second):
 	}
 }
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -30,14 +34,58 @@ func TestDetailParsing(t *testing.T) {
 }
 
 func TestSnapshotParsing(t *testing.T) {
-	fn := "26-20170518102400-snapshot.jpg"
-	ts, err := parseSnapshotTime(fn)
+	tests := []struct {
+		tz, fn, want string
+	}{
+		{"America/Los_Angeles", "26-20170518102400-snapshot.jpg", "2017-05-18T10:24:00-07:00"},
+		{"UTC", "26-20170518102400-snapshot.jpg", "2017-05-18T10:24:00Z"},
+		{"Europe/Berlin", "3-20171231235959-snapshot.jpg", "2017-12-31T23:59:59+01:00"},
+	}
+	for _, test := range tests {
+		cam := &camera{ID: "test", Timezone: test.tz}
+		cam.applyDefaults()
+		if err := cam.compileNaming(); err != nil {
+			t.Fatal(err)
+		}
+		ts, err := cam.parseSnapshotTime(test.fn)
+		if err != nil {
+			t.Fatalf("Failure parsing %v: %v", test.fn, err)
+		}
+		if got := ts.Format(time.RFC3339); got != test.want {
+			t.Errorf("parse(%v) in %v = %v, want %v", test.fn, test.tz, got, test.want)
+		}
+	}
+}
+
+func TestUploadedClipNotRecounted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "motion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cam := &camera{ID: "test", Dir: dir}
+	cam.jrnl, err = openJournal(filepath.Join(dir, ".uploader.journal"), time.Hour)
 	if err != nil {
-		t.Fatalf("Failure parsing: %v", err)
+		t.Fatal(err)
+	}
+	c := clip{ts: time.Date(2017, 5, 18, 10, 24, 0, 0, time.Local)}
+	cam.jrnl.record(c.key(), func(s *clipState) {
+		s.Uploaded["jpg"], s.Uploaded["mp4"], s.Uploaded["avi"] = true, true, true
+		s.Notified = true
+	})
+
+	for i := 0; i < 3; i++ {
+		if err := cam.uploadClip(context.Background(), c); err != nil {
+			t.Fatalf("uploadClip: %v", err)
+		}
+	}
+	if got := cam.summary(); !strings.HasPrefix(got, "0 uploaded") {
+		t.Errorf("summary after rescanning an uploaded clip = %v", got)
 	}
-	got := ts.Format(time.RFC3339)
-	want := "2017-05-18T10:24:00-07:00"
-	if got != want {
-		t.Errorf("parse(%v) = %v, want %v", fn, got, want)
+	cam.health.mu.Lock()
+	defer cam.health.mu.Unlock()
+	if !cam.health.lastUpload.IsZero() {
+		t.Errorf("rescanning an uploaded clip counted as an upload")
 	}
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+)
+
+// How long the watcher will hold on to part of a clip before leaving
+// it for the rescan to find.
+const maxPendingAge = time.Hour
+
+// watchClips watches the camera's directory, uploading each clip as soon as all of
+// its files have been written, and each snapshot as soon as it's
+// linked as the latest.
+func (cam *camera) watchClips(ctx context.Context) error {
+	names, err := watchDir(ctx, cam.Dir)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		clips := map[int]clip{}
+		seen := map[int]time.Time{}
+
+		for name := range names {
+			if name == "lastsnap.jpg" {
+				go func() {
+					if err := cam.uploadLatestSnapshot(ctx); err != nil {
+						log.Printf("%v: error uploading the latest snapshot: %v", cam.ID, err)
+					}
+				}()
+				continue
+			}
+
+			st, err := os.Stat(cam.fq(name))
+			if err != nil {
+				// Most likely already uploaded and cleaned up.
+				continue
+			}
+			id, ok := cam.addClipFile(clips, st)
+			if !ok {
+				continue
+			}
+			if _, ok := seen[id]; !ok {
+				seen[id] = time.Now()
+			}
+
+			if c := clips[id]; c.complete() {
+				delete(clips, id)
+				delete(seen, id)
+				ch := clipWork.submit(ctx, cam, c)
+				go func() {
+					if err := <-ch; err != nil {
+						log.Printf("%v: error uploading watched clip: %v", cam.ID, err)
+					}
+				}()
+			}
+
+			for id, t := range seen {
+				if time.Since(t) > maxPendingAge {
+					delete(clips, id)
+					delete(seen, id)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
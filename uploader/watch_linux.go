@@ -0,0 +1,76 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchDir reports the names of files in dir once they're done being
+// written, moved into place, or (for symlinks) created.
+func watchDir(ctx context.Context, dir string) (<-chan string, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := unix.InotifyAddWatch(fd, dir, unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO|unix.IN_CREATE); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	// Non-blocking, so reads go through the runtime poller and Close
+	// wakes up a pending Read.
+	f := os.NewFile(uintptr(fd), "inotify")
+
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+
+	ch := make(chan string, 64)
+	go func() {
+		defer close(ch)
+		buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("Error reading inotify events: %v", err)
+				}
+				return
+			}
+			for off := 0; off+unix.SizeofInotifyEvent <= n; {
+				ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+				name := string(bytes.TrimRight(buf[off+unix.SizeofInotifyEvent:off+unix.SizeofInotifyEvent+int(ev.Len)], "\x00"))
+				off += unix.SizeofInotifyEvent + int(ev.Len)
+
+				if ev.Mask&unix.IN_Q_OVERFLOW != 0 {
+					log.Printf("inotify queue overflowed, leaving it for the next rescan")
+					continue
+				}
+				if ev.Mask&unix.IN_CREATE != 0 {
+					// Regular files aren't done until they're closed.
+					st, err := os.Lstat(filepath.Join(dir, name))
+					if err != nil || st.Mode()&os.ModeSymlink == 0 {
+						continue
+					}
+				}
+
+				select {
+				case ch <- name:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return ch, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+func watchDir(ctx context.Context, dir string) (<-chan string, error) {
+	return nil, errors.New("directory watching is only supported on linux")
+}
@@ -1,14 +1,19 @@
 package vidtool
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"time"
+
+	"github.com/dustin/reye/logging"
 )
 
 var (
@@ -18,14 +23,48 @@ var (
 		"maximum acceptable duration drift when transcoding videos")
 )
 
+// A ToolError is a failed run of ffmpeg or ffprobe, along with
+// whatever it had to say about it.
+type ToolError struct {
+	Tool   string
+	Err    error
+	Stderr string
+}
+
+func (e *ToolError) Error() string {
+	if e.Stderr == "" {
+		return fmt.Sprintf("%v: %v", e.Tool, e.Err)
+	}
+	return fmt.Sprintf("%v: %v: %v", e.Tool, e.Err, e.Stderr)
+}
+
+func (e *ToolError) Unwrap() error {
+	return e.Err
+}
+
+// run runs a tool, returning its output.  Anything it writes to stderr
+// goes into the error if it fails, and to ctx's log otherwise.
+func run(ctx context.Context, tool string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, tool, args...)
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	err := cmd.Run()
+	msg := strings.TrimSpace(stderr.String())
+	if err != nil {
+		return nil, &ToolError{Tool: filepath.Base(tool), Err: err, Stderr: msg}
+	}
+	if msg != "" {
+		logging.From(ctx).Warn("tool output", logging.Tool, filepath.Base(tool), logging.Stderr, msg)
+	}
+	return stdout.Bytes(), nil
+}
+
 func ClipDuration(ctx context.Context, fn string) (time.Duration, error) {
 	printfmt := "-print_format"
 	if strings.HasSuffix(*ffprobe, "avprobe") {
 		printfmt = "-of"
 	}
-	cmd := exec.CommandContext(ctx, *ffprobe, "-v", "error", printfmt, "json", "-show_format", fn)
-	cmd.Stderr = os.Stderr
-	o, err := cmd.Output()
+	o, err := run(ctx, *ffprobe, "-v", "error", printfmt, "json", "-show_format", fn)
 	if err != nil {
 		return 0, err
 	}
@@ -55,21 +94,67 @@ func Transcode(ctx context.Context, iname, oname string) (time.Duration, error)
 		return 0, err
 	}
 
-	cmd := exec.CommandContext(ctx, *ffmpeg, "-y", "-v", "warning", "-i", iname, oname)
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	if err := cmd.Run(); err != nil {
+	if _, err := run(ctx, *ffmpeg, "-y", "-v", "warning", "-i", iname, oname); err != nil {
+		// Don't leave partial output behind (e.g. when cancelled).
+		os.Remove(oname)
 		return 0, err
 	}
 
 	odur, err := ClipDuration(ctx, oname)
 	if err != nil {
+		os.Remove(oname)
 		return 0, err
 	}
 
 	if abs(odur-idur) > *maxDurationDrift {
+		os.Remove(oname)
 		return 0, fmt.Errorf("durations inconsistent, in=%v, out=%v", idur, odur)
 	}
 
 	return odur, nil
 }
+
+// Thumbnail writes a representative frame of the video iname to oname.
+func Thumbnail(ctx context.Context, iname, oname string) error {
+	if _, err := run(ctx, *ffmpeg, "-y", "-v", "warning", "-i", iname,
+		"-vf", "thumbnail", "-frames:v", "1", oname); err != nil {
+		os.Remove(oname)
+		return err
+	}
+	return nil
+}
+
+// Timelapse writes the images in frames to the video oname at fps
+// frames per second, returning the video's duration.
+func Timelapse(ctx context.Context, frames []string, fps int, oname string) (time.Duration, error) {
+	if len(frames) == 0 {
+		return 0, fmt.Errorf("no frames for %v", oname)
+	}
+
+	// ffmpeg's concat demuxer takes the frames (and how long to show
+	// each) from a list.  The last one is repeated, or its duration is
+	// ignored.
+	list := oname + ".ffconcat"
+	var b strings.Builder
+	b.WriteString("ffconcat version 1.0\n")
+	for _, fn := range append(frames, frames[len(frames)-1]) {
+		fmt.Fprintf(&b, "file '%s'\nduration %f\n", strings.Replace(fn, "'", `'\''`, -1), 1/float64(fps))
+	}
+	if err := ioutil.WriteFile(list, []byte(b.String()), 0644); err != nil {
+		return 0, err
+	}
+	defer os.Remove(list)
+
+	if _, err := run(ctx, *ffmpeg, "-y", "-v", "warning", "-f", "concat", "-safe", "0", "-i", list,
+		"-vf", fmt.Sprintf("fps=%d,format=yuv420p", fps), oname); err != nil {
+		os.Remove(oname)
+		return 0, err
+	}
+
+	odur, err := ClipDuration(ctx, oname)
+	if err != nil {
+		os.Remove(oname)
+		return 0, err
+	}
+	return odur, nil
+}
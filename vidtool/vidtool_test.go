@@ -0,0 +1,27 @@
+package vidtool
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"testing"
+)
+
+func TestRunCapturesStderr(t *testing.T) {
+	ctx := context.Background()
+	out, err := run(ctx, "sh", "-c", "echo out; echo complaint >&2")
+	if err != nil || string(out) != "out\n" {
+		t.Errorf("run = %q, %v", out, err)
+	}
+
+	_, err = run(ctx, "sh", "-c", "echo broken >&2; exit 1")
+	var te *ToolError
+	if !errors.As(err, &te) || te.Tool != "sh" || te.Stderr != "broken" {
+		t.Errorf("run failure = %#v", err)
+	}
+
+	_, err = run(ctx, "reye-no-such-tool")
+	if !errors.Is(err, exec.ErrNotFound) {
+		t.Errorf("missing tool = %v, want ErrNotFound", err)
+	}
+}